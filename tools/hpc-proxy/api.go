@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Internal endpoints live under a prefix no upstream route can collide with
+const (
+	internalPrefix = "/_hpc-proxy/"
+	healthPath     = internalPrefix + "health"
+	portsAPIPath   = internalPrefix + "api/ports"
+	statusPath     = internalPrefix + "api/status"
+)
+
+// healthInfo is returned by the health endpoint and used to detect a live
+// instance at startup. UID and hostname tell our own instances apart from
+// other users' or other nodes' proxies answering on a recorded port.
+type healthInfo struct {
+	Status   string `json:"status"`
+	PID      int    `json:"pid"`
+	Port     int    `json:"port"`
+	Version  string `json:"version"`
+	UID      int    `json:"uid"`
+	Hostname string `json:"hostname"`
+}
+
+// serveHealth reports liveness. It is exempt from token auth because it
+// exposes nothing beyond the PID, UID, hostname and version.
+func (p *Proxy) serveHealth(w http.ResponseWriter, r *http.Request) {
+	hostname, _ := os.Hostname()
+	writeJSON(w, http.StatusOK, healthInfo{
+		Status:   "ok",
+		PID:      os.Getpid(),
+		Port:     p.port,
+		Version:  version,
+		UID:      p.uid,
+		Hostname: hostname,
+	})
+}
+
+// listeningPort describes one of the user's listening TCP ports
+type listeningPort struct {
+	Port        int      `json:"port"`
+	Addresses   []string `json:"addresses"`
+	PID         int      `json:"pid,omitempty"`
+	Command     string   `json:"command,omitempty"`
+	Service     string   `json:"service,omitempty"`
+	ServiceName string   `json:"service_name,omitempty"`
+	Rewrite     bool     `json:"rewrite"`
+	Shim        bool     `json:"shim"`
+	URL         string   `json:"url"`
+}
+
+// serveInternal dispatches requests under /_hpc-proxy/
+func (p *Proxy) serveInternal(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case portsAPIPath:
+		p.servePorts(w, r)
+	case statusPath:
+		p.serveStatus(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// servePorts lists the TCP ports the proxy user is listening on, plus Unix
+// socket upstreams, so the manager can offer links instead of asking for a
+// port number
+func (p *Proxy) servePorts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ports, err := p.listUserPorts()
+	if err != nil {
+		log.Printf("Failed to list ports: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	sockets, err := p.listUserSockets()
+	if err != nil {
+		log.Printf("Failed to list sockets: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ports": ports, "sockets": sockets})
+}
+
+// listUserPorts returns LISTEN sockets owned by the proxy's UID, one entry
+// per port (IPv4 and IPv6 listeners are merged), excluding the proxy itself
+func (p *Proxy) listUserPorts() ([]listeningPort, error) {
+	sockets, err := p.procfs.listeningSockets()
+	if err != nil {
+		return nil, err
+	}
+	pids := p.procfs.socketPIDs()
+
+	byPort := make(map[int]*listeningPort)
+	for _, s := range sockets {
+		if s.UID != p.uid || s.Port == p.port {
+			continue
+		}
+		entry, ok := byPort[s.Port]
+		if !ok {
+			entry = &listeningPort{
+				Port: s.Port,
+				Shim: p.shim.has(s.Port),
+				URL:  fmt.Sprintf("%s/port/%d/", p.externalPrefix, s.Port),
+			}
+			byPort[s.Port] = entry
+		}
+		entry.Addresses = append(entry.Addresses, s.IP.String())
+		if entry.PID == 0 {
+			if pid, ok := pids[s.Inode]; ok {
+				entry.PID = pid
+				entry.Command = p.procfs.cmdline(pid)
+			}
+		}
+	}
+
+	// Identify services concurrently; each probe is bounded by probeTimeout
+	var wg sync.WaitGroup
+	for _, entry := range byPort {
+		wg.Add(1)
+		go func(entry *listeningPort) {
+			defer wg.Done()
+			entry.Service = p.identifyService(entry.Port, entry.Command)
+			entry.Rewrite = p.baseRewrite
+			if info, ok := services[entry.Service]; ok {
+				entry.ServiceName = info.Name
+				if p.autoRewrite {
+					entry.Rewrite = info.Rewrite
+				}
+			}
+		}(entry)
+	}
+	wg.Wait()
+
+	ports := make([]listeningPort, 0, len(byPort))
+	for _, entry := range byPort {
+		ports = append(ports, *entry)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Port < ports[j].Port })
+	return ports, nil
+}
+
+// writeJSON encodes v as the response body with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to encode JSON response: %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// addFakeProcess adds /proc/<pid>/cmdline and a socket fd to a fake procfs
+func addFakeProcess(t *testing.T, root, pid, cmdline, inode string) {
+	t.Helper()
+	fdDir := filepath.Join(root, pid, "fd")
+	if err := os.MkdirAll(fdDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, pid, "cmdline"), []byte(cmdline), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("socket:["+inode+"]", filepath.Join(fdDir, "3")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListUserPorts(t *testing.T) {
+	tcp := strings.Join([]string{
+		// 127.0.0.1:5500 LISTEN uid 1000, inode 1001
+		"   0: 0100007F:157C 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 1001 1 0000000000000000 100 0 0 10 0",
+		// 0.0.0.0:3838 LISTEN uid 2000 (other user)
+		"   1: 00000000:0EFE 00000000:0000 0A 00000000:00000000 00:00000000 00000000  2000        0 1002 1 0000000000000000 100 0 0 10 0",
+		// 0.0.0.0:9001 LISTEN uid 1000 (the proxy itself)
+		"   2: 00000000:2329 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 1003 1 0000000000000000 100 0 0 10 0",
+	}, "\n") + "\n"
+	tcp6 := strings.Join([]string{
+		// [::1]:5500 LISTEN uid 1000 (same port, IPv6)
+		"   0: 00000000000000000000000001000000:157C 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 1004 1 0000000000000000 100 0 0 10 0",
+		// [::1]:5173 LISTEN uid 1000, no visible process
+		"   1: 00000000000000000000000001000000:1435 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 1005 1 0000000000000000 100 0 0 10 0",
+	}, "\n") + "\n"
+	root := writeFakeProc(t, tcp, tcp6)
+	addFakeProcess(t, root, "4242", "live-server\x00--port=5500\x00", "1001")
+
+	p := NewProxy(9001, false, false)
+	p.uid = 1000
+	p.procfs = procFS{root: root}
+
+	ports, err := p.listUserPorts()
+	if err != nil {
+		t.Fatalf("listUserPorts() error = %v", err)
+	}
+	if len(ports) != 2 {
+		t.Fatalf("expected 2 ports, got %+v", ports)
+	}
+
+	if ports[0].Port != 5173 || ports[0].PID != 0 || ports[0].URL != "/port/5173/" {
+		t.Errorf("unexpected entry for 5173: %+v", ports[0])
+	}
+	live := ports[1]
+	if live.Port != 5500 || live.PID != 4242 || live.Command != "live-server --port=5500" {
+		t.Errorf("unexpected entry for 5500: %+v", live)
+	}
+	if strings.Join(live.Addresses, ",") != "127.0.0.1,::1" {
+		t.Errorf("addresses = %v, want both IPv4 and IPv6 loopback", live.Addresses)
+	}
+}
+
+func TestServePortsAPI(t *testing.T) {
+	tcp := "   0: 0100007F:157C 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 1001 1 0000000000000000 100 0 0 10 0\n"
+
+	p := NewProxy(9001, false, false)
+	p.uid = 1000
+	p.procfs = procFS{root: writeFakeProc(t, tcp, "")}
+
+	req := httptest.NewRequest("GET", portsAPIPath, nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var body struct {
+		Ports []listeningPort `json:"ports"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if len(body.Ports) != 1 || body.Ports[0].Port != 5500 {
+		t.Errorf("unexpected ports: %+v", body.Ports)
+	}
+
+	// Other methods and unknown internal paths are rejected
+	req = httptest.NewRequest("POST", portsAPIPath, nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want 405", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", internalPrefix+"nope", nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown path status = %d, want 404", w.Code)
+	}
+}
+
+func TestServePortsRequiresToken(t *testing.T) {
+	p := NewProxy(9001, false, false)
+	p.token = "secret"
+
+	req := httptest.NewRequest("GET", portsAPIPath, nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", w.Code)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// tokenCookieName holds the shared secret after a ?token= exchange
+	tokenCookieName = "hpc_proxy_token"
+	// tokenQueryParam is the query parameter accepted on first visit
+	tokenQueryParam = "token"
+)
+
+// generateToken returns a random 256-bit hex token
+func generateToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("read random: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// authenticate checks the shared-secret token on an incoming request.
+// The token is accepted from (in order) an "Authorization: Bearer" header,
+// the hpc_proxy_token cookie, or a ?token= query parameter. A valid query
+// token is exchanged for an HttpOnly cookie so that subsequent requests,
+// including WebSocket upgrades issued by page scripts, carry it automatically.
+//
+// Credentials consumed by the proxy are stripped from the request so they
+// never reach the upstream service. Returns false if a response has
+// already been written (401 or redirect).
+func (p *Proxy) authenticate(w http.ResponseWriter, r *http.Request) bool {
+	if p.token == "" {
+		return true
+	}
+
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		if p.tokenMatches(strings.TrimPrefix(auth, "Bearer ")) {
+			r.Header.Del("Authorization")
+			stripTokenCookie(r)
+			return true
+		}
+	}
+
+	if c, err := r.Cookie(tokenCookieName); err == nil && p.tokenMatches(c.Value) {
+		stripTokenCookie(r)
+		return true
+	}
+
+	query := r.URL.Query()
+	if query.Has(tokenQueryParam) && p.tokenMatches(query.Get(tokenQueryParam)) {
+		http.SetCookie(w, &http.Cookie{
+			Name:     tokenCookieName,
+			Value:    p.token,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   requestProto(r) == "https",
+			SameSite: http.SameSiteLaxMode,
+		})
+		query.Del(tokenQueryParam)
+		r.URL.RawQuery = query.Encode()
+		stripTokenCookie(r)
+
+		// Browser navigations are redirected so the token leaves the address bar;
+		// WebSocket upgrades and other methods continue with the token removed
+		if r.Method == http.MethodGet && !isWebSocketUpgrade(r) {
+			http.Redirect(w, r, p.externalPrefix+r.URL.RequestURI(), http.StatusFound)
+			return false
+		}
+		return true
+	}
+
+	w.Header().Set("WWW-Authenticate", `Bearer realm="hpc-proxy"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// tokenMatches compares a candidate against the proxy token in constant time
+func (p *Proxy) tokenMatches(candidate string) bool {
+	return subtle.ConstantTimeCompare([]byte(candidate), []byte(p.token)) == 1
+}
+
+// stripTokenCookie removes the proxy's own cookie from the Cookie header,
+// leaving any cookies that belong to the upstream application untouched
+func stripTokenCookie(r *http.Request) {
+	values := r.Header.Values("Cookie")
+	if len(values) == 0 {
+		return
+	}
+	var kept []string
+	for _, line := range values {
+		for _, part := range strings.Split(line, ";") {
+			part = strings.TrimSpace(part)
+			if part == "" || strings.HasPrefix(part, tokenCookieName+"=") {
+				continue
+			}
+			kept = append(kept, part)
+		}
+	}
+	if len(kept) == 0 {
+		r.Header.Del("Cookie")
+		return
+	}
+	r.Header.Set("Cookie", strings.Join(kept, "; "))
+}
+
+// isWebSocketUpgrade reports whether r asks to switch to the WebSocket protocol
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// requestProto returns the client-facing scheme, honouring X-Forwarded-Proto
+// from the manager's tunnel
+func requestProto(r *http.Request) string {
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		return proto
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerateToken(t *testing.T) {
+	a, err := generateToken()
+	if err != nil {
+		t.Fatalf("generateToken() error = %v", err)
+	}
+	b, _ := generateToken()
+	if len(a) != 64 {
+		t.Errorf("expected 64 hex chars, got %d", len(a))
+	}
+	if a == b {
+		t.Error("expected distinct tokens")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	p := NewProxy(0, false, false)
+	p.token = "secret"
+
+	tests := []struct {
+		name         string
+		method       string
+		url          string
+		header       http.Header
+		wantOk       bool
+		wantStatus   int
+		wantCookie   bool
+		wantLocation string
+	}{
+		{
+			name:       "no credentials",
+			method:     "GET",
+			url:        "/port/5500/",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:   "bearer header",
+			method: "GET",
+			url:    "/port/5500/",
+			header: http.Header{"Authorization": []string{"Bearer secret"}},
+			wantOk: true,
+		},
+		{
+			name:       "wrong bearer header",
+			method:     "GET",
+			url:        "/port/5500/",
+			header:     http.Header{"Authorization": []string{"Bearer nope"}},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:   "cookie",
+			method: "GET",
+			url:    "/port/5500/",
+			header: http.Header{"Cookie": []string{"hpc_proxy_token=secret"}},
+			wantOk: true,
+		},
+		{
+			name:         "query token on navigation redirects",
+			method:       "GET",
+			url:          "/port/5500/app?x=1&token=secret",
+			wantStatus:   http.StatusFound,
+			wantCookie:   true,
+			wantLocation: "/port/5500/app?x=1",
+		},
+		{
+			name:       "query token on websocket upgrade continues",
+			method:     "GET",
+			url:        "/port/5500/ws?token=secret",
+			header:     http.Header{"Upgrade": []string{"websocket"}, "Connection": []string{"Upgrade"}},
+			wantOk:     true,
+			wantCookie: true,
+		},
+		{
+			name:       "query token on POST continues",
+			method:     "POST",
+			url:        "/port/5500/api?token=secret",
+			wantOk:     true,
+			wantCookie: true,
+		},
+		{
+			name:       "wrong query token",
+			method:     "GET",
+			url:        "/port/5500/?token=nope",
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, nil)
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			w := httptest.NewRecorder()
+
+			ok := p.authenticate(w, req)
+			if ok != tt.wantOk {
+				t.Fatalf("authenticate() = %v, want %v", ok, tt.wantOk)
+			}
+			if !ok && w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if ok && req.URL.Query().Has(tokenQueryParam) {
+				t.Errorf("token query parameter not stripped: %s", req.URL.RawQuery)
+			}
+
+			setCookie := w.Header().Get("Set-Cookie")
+			if tt.wantCookie {
+				if !strings.Contains(setCookie, "hpc_proxy_token=secret") || !strings.Contains(setCookie, "HttpOnly") {
+					t.Errorf("expected HttpOnly token cookie, got %q", setCookie)
+				}
+			} else if setCookie != "" {
+				t.Errorf("unexpected Set-Cookie %q", setCookie)
+			}
+			if tt.wantLocation != "" && w.Header().Get("Location") != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", w.Header().Get("Location"), tt.wantLocation)
+			}
+		})
+	}
+}
+
+func TestAuthenticateDisabled(t *testing.T) {
+	p := NewProxy(0, false, false)
+
+	req := httptest.NewRequest("GET", "/port/5500/", nil)
+	w := httptest.NewRecorder()
+	if !p.authenticate(w, req) {
+		t.Errorf("expected requests to pass when no token is configured, got %d", w.Code)
+	}
+}
+
+func TestAuthCredentialsNotForwarded(t *testing.T) {
+	var gotAuth, gotCookie string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		gotCookie = r.Header.Get("Cookie")
+	}))
+	defer backend.Close()
+	backendPort := strings.TrimPrefix(backend.URL, "http://127.0.0.1:")
+
+	p := NewProxy(0, false, false)
+	p.token = "secret"
+
+	req := httptest.NewRequest("GET", "/port/"+backendPort+"/", nil)
+	req.Header.Set("Cookie", "session=abc; hpc_proxy_token=secret; theme=dark")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if gotAuth != "" {
+		t.Errorf("Authorization forwarded upstream: %q", gotAuth)
+	}
+	if gotCookie != "session=abc; theme=dark" {
+		t.Errorf("upstream Cookie = %q, want application cookies only", gotCookie)
+	}
+}
+
+func TestWritePortFileWithToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hpc-proxy", "port")
+
+	if err := writePortFile(path, 9001, "secret"); err != nil {
+		t.Fatalf("writePortFile() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "9001\nsecret\n" {
+		t.Errorf("port file = %q", data)
+	}
+	info, _ := os.Stat(path)
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("port file mode = %o, want 600", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Defaults for on-the-fly compression of responses sent to the client
+const (
+	defaultCompressTypes   = "text/*,application/javascript,application/json,application/xml,application/wasm,image/svg+xml"
+	defaultCompressMinSize = 1024
+)
+
+// contentEncoder is a compressing writer that can emit everything
+// written so far without ending the stream
+type contentEncoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// contentEncoders wrap the output of a compressed response body. The
+// levels favour speed: bodies are compressed as they stream through.
+var contentEncoders = map[string]func(w io.Writer) contentEncoder{
+	"br": func(w io.Writer) contentEncoder {
+		return brotli.NewWriterLevel(w, 4)
+	},
+	"zstd": func(w io.Writer) contentEncoder {
+		enc, _ := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedDefault))
+		return enc
+	},
+	"gzip": func(w io.Writer) contentEncoder {
+		return gzip.NewWriter(w)
+	},
+}
+
+// encodingPreference breaks ties between equally acceptable encodings
+var encodingPreference = []string{"br", "zstd", "gzip"}
+
+// compressConfig selects which responses are compressed for the client
+type compressConfig struct {
+	types   []string // media types, with "type/*" wildcards; empty disables
+	minSize int64    // smallest Content-Length worth compressing
+}
+
+// parseCompressTypes splits a comma-separated media type list
+func parseCompressTypes(s string) []string {
+	var types []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// matches reports whether a Content-Type is in the configured list.
+// Event streams never are: compression would hold events back.
+func (c compressConfig) matches(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "text/event-stream" {
+		return false
+	}
+	for _, t := range c.types {
+		if t == mediaType || strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// chooseEncoding picks the encoding the client prefers from those the
+// proxy can produce, or "" if it accepts none of them
+func chooseEncoding(accept string) string {
+	q := make(map[string]float64)
+	wildcard := -1.0
+	for _, part := range strings.Split(accept, ",") {
+		token, params, _ := strings.Cut(part, ";")
+		token = strings.ToLower(strings.TrimSpace(token))
+		if token == "x-gzip" {
+			token = "gzip"
+		}
+		if token == "*" {
+			wildcard = acceptQ(params)
+			continue
+		}
+		q[token] = acceptQ(params)
+	}
+
+	best, bestQ := "", 0.0
+	for _, e := range encodingPreference {
+		eq, ok := q[e]
+		if !ok {
+			eq = wildcard
+		}
+		if eq > bestQ {
+			best, bestQ = e, eq
+		}
+	}
+	return best
+}
+
+// compressResponse compresses an uncompressed response body with the best
+// encoding the client advertised, so rewritten pages and plain text from
+// upstreams cross the SSH tunnel compressed. acceptEncoding is the
+// client's header, since the upstream request may have been narrowed.
+func (p *Proxy) compressResponse(resp *http.Response, acceptEncoding string) {
+	if len(p.compress.types) == 0 || resp.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	switch {
+	case resp.StatusCode < 200, resp.StatusCode == http.StatusNoContent,
+		resp.StatusCode == http.StatusNotModified, resp.StatusCode == http.StatusPartialContent:
+		return
+	case resp.Request != nil && resp.Request.Method == http.MethodHead:
+		return
+	case resp.ContentLength >= 0 && resp.ContentLength < p.compress.minSize:
+		return
+	case strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-transform"):
+		return
+	case !p.compress.matches(resp.Header.Get("Content-Type")):
+		return
+	}
+	encoding := chooseEncoding(acceptEncoding)
+	if encoding == "" {
+		return
+	}
+
+	resp.Body = newCompressReader(resp.Body, contentEncoders[encoding])
+	resp.Header.Set("Content-Encoding", encoding)
+	resp.Header.Add("Vary", "Accept-Encoding")
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	// The bytes changed, so a strong validator no longer holds
+	if etag := resp.Header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+}
+
+// compressFlushDelay is how long the upstream may pause before what it
+// sent so far is flushed to the client. Shorter gaps, like those between
+// the many small reads of a rewritten page, are waited out so the output
+// is compressed together.
+const compressFlushDelay = 10 * time.Millisecond
+
+// compressReader streams a body through an encoder. The body is read on
+// its own goroutine, so when the upstream stalls part way (logs, progress
+// output) the encoder is flushed and what arrived reaches the client
+// instead of waiting for a block to fill.
+type compressReader struct {
+	src    io.ReadCloser // owned by pump, which also closes it
+	enc    contentEncoder
+	chunks chan []byte   // read from src by pump; closed when it stops
+	done   chan struct{} // hands the chunk buffer back to pump
+	stop   chan struct{} // closed with the reader
+	srcErr error         // why pump stopped, once chunks is closed
+	dirty  bool          // the encoder holds input not yet flushed
+	closed bool
+	out    bytes.Buffer
+	err    error
+}
+
+func newCompressReader(src io.ReadCloser, encoder func(w io.Writer) contentEncoder) *compressReader {
+	cr := &compressReader{
+		src:    src,
+		chunks: make(chan []byte),
+		done:   make(chan struct{}),
+		stop:   make(chan struct{}),
+	}
+	cr.enc = encoder(&cr.out)
+	go cr.pump()
+	return cr
+}
+
+func (cr *compressReader) Read(p []byte) (int, error) {
+	for cr.out.Len() == 0 && cr.err == nil {
+		cr.fill()
+	}
+	if cr.out.Len() > 0 {
+		return cr.out.Read(p)
+	}
+	return 0, cr.err
+}
+
+// Close releases the encoder and stops reading the body. A read already
+// waiting on the upstream ends when the request is cancelled, and the
+// body is closed then.
+func (cr *compressReader) Close() error {
+	if cr.closed {
+		return nil
+	}
+	cr.closed = true
+	if cr.err == nil {
+		// Release the encoder of an abandoned body
+		cr.enc.Close()
+	}
+	close(cr.stop)
+	return nil
+}
+
+// pump reads the body and hands each chunk to fill
+func (cr *compressReader) pump() {
+	defer close(cr.chunks)
+	defer cr.src.Close()
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := cr.src.Read(buf)
+		if n > 0 {
+			select {
+			case cr.chunks <- buf[:n]:
+			case <-cr.stop:
+				return
+			}
+			select {
+			case <-cr.done:
+			case <-cr.stop:
+				return
+			}
+		}
+		if err != nil {
+			cr.srcErr = err
+			return
+		}
+	}
+}
+
+// fill compresses the next chunk of the body into the output, or flushes
+// the encoder if the upstream pauses with input still held in it
+func (cr *compressReader) fill() {
+	var chunk []byte
+	var ok bool
+	if cr.dirty {
+		timer := time.NewTimer(compressFlushDelay)
+		select {
+		case chunk, ok = <-cr.chunks:
+			timer.Stop()
+		case <-timer.C:
+			cr.dirty = false
+			if err := cr.enc.Flush(); err != nil {
+				cr.err = err
+			}
+			return
+		}
+	} else {
+		chunk, ok = <-cr.chunks
+	}
+
+	if !ok {
+		err := cr.srcErr
+		if err == io.EOF {
+			if cerr := cr.enc.Close(); cerr != nil {
+				err = cerr
+			}
+		}
+		cr.err = err
+		return
+	}
+	_, err := cr.enc.Write(chunk)
+	cr.done <- struct{}{}
+	if err != nil {
+		cr.err = err
+		return
+	}
+	cr.dirty = true
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChooseEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"gzip, deflate, br, zstd", "br"},
+		{"gzip, deflate", "gzip"},
+		{"gzip;q=1.0, br;q=0.5", "gzip"},
+		{"br;q=0, gzip", "gzip"},
+		{"*", "br"},
+		{"*;q=0.5, gzip", "gzip"},
+		{"deflate, identity", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := chooseEncoding(tt.accept); got != tt.want {
+			t.Errorf("chooseEncoding(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestCompressConfigMatches(t *testing.T) {
+	c := compressConfig{types: parseCompressTypes(defaultCompressTypes)}
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"text/html; charset=utf-8", true},
+		{"text/css", true},
+		{"application/json", true},
+		{"image/svg+xml", true},
+		{"image/png", false},
+		{"application/octet-stream", false},
+		{"text/event-stream", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := c.matches(tt.contentType); got != tt.want {
+			t.Errorf("matches(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestProxyCompressesResponses(t *testing.T) {
+	page := `<html><head></head><body>` + strings.Repeat(`<a href="/item">item</a>`, 200) + `</body></html>`
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("ok"))
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(bytes.Repeat([]byte{0}, 4096))
+		case "/encoded":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(encode(t, "gzip", strings.Repeat("x", 4096)))
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte(page))
+		}
+	}))
+	defer backend.Close()
+	backendPort := strings.TrimPrefix(backend.URL, "http://127.0.0.1:")
+
+	get := func(p *Proxy, path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/port/"+backendPort+path, nil)
+		req.Header.Set("Accept-Encoding", accept)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: expected status 200, got %d", path, w.Code)
+		}
+		return w
+	}
+
+	p := NewProxy(0, true, false)
+	p.ownerCheck = false
+
+	// Rewritten HTML is re-encoded with the client's preferred encoding
+	for _, encoding := range []string{"br", "gzip", "zstd"} {
+		t.Run(encoding, func(t *testing.T) {
+			w := get(p, "/", encoding)
+			if got := w.Header().Get("Content-Encoding"); got != encoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, encoding)
+			}
+			if got := w.Header().Get("ETag"); got != `W/"v1"` {
+				t.Errorf("ETag = %q, want weakened", got)
+			}
+			if w.Body.Len() >= len(page) {
+				t.Errorf("compressed body is %d bytes, page is %d", w.Body.Len(), len(page))
+			}
+			decoded, err := decodeBody(encoding, io.NopCloser(w.Body))
+			if err != nil {
+				t.Fatalf("decodeBody() error = %v", err)
+			}
+			body, err := io.ReadAll(decoded)
+			if err != nil {
+				t.Fatalf("read %s body: %v", encoding, err)
+			}
+			if !strings.Contains(string(body), `<a href="/port/`+backendPort+`/item">`) {
+				t.Errorf("expected rewritten page after decoding, got: %.200s", body)
+			}
+		})
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		accept string
+		want   string
+	}{
+		{"client without compression", "/", "", ""},
+		{"below minimum size", "/small", "gzip", ""},
+		{"type not listed", "/image", "gzip", ""},
+		{"already encoded upstream", "/encoded", "gzip", "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := get(p, tt.path, tt.accept).Header().Get("Content-Encoding"); got != tt.want {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// An empty type list turns compression off
+	p.compress.types = nil
+	if got := get(p, "/", "gzip").Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("Content-Encoding = %q with compression disabled", got)
+	}
+}
+
+func TestProxyCompressedStreamFlushes(t *testing.T) {
+	// Streams a line of log output, then stalls like a long-running job
+	done := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("step 1 of 2 done\n"))
+		w.(http.Flusher).Flush()
+		<-done
+	}))
+	defer backend.Close()
+	defer close(done)
+	backendPort := strings.TrimPrefix(backend.URL, "http://127.0.0.1:")
+
+	p := NewProxy(0, false, false)
+	p.ownerCheck = false
+	port, err := p.Start()
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer p.Shutdown()
+
+	for _, encoding := range encodingPreference {
+		t.Run(encoding, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d/port/%s/log", port, backendPort), nil)
+			req.Header.Set("Accept-Encoding", encoding)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("GET through proxy: %v", err)
+			}
+			defer resp.Body.Close()
+			if got := resp.Header.Get("Content-Encoding"); got != encoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, encoding)
+			}
+
+			line := make(chan string, 1)
+			go func() {
+				decoded, err := decodeBody(encoding, resp.Body)
+				if err != nil {
+					line <- err.Error()
+					return
+				}
+				s, _ := bufio.NewReader(decoded).ReadString('\n')
+				line <- s
+			}()
+			select {
+			case got := <-line:
+				if got != "step 1 of 2 done\n" {
+					t.Errorf("first line = %q", got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("first line held back until the stream ends")
+			}
+		})
+	}
+}
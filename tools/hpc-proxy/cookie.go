@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// cookieNamespaceMarker starts every namespaced cookie name, so cookies
+// namespaced for other routes can be recognised and withheld
+const cookieNamespaceMarker = "hpc."
+
+// cookieNamespace returns the name prefix for cookies set through a route,
+// e.g. "hpc.port-5500." for /port/5500
+func cookieNamespace(prefix string) string {
+	return cookieNamespaceMarker + strings.ReplaceAll(strings.Trim(prefix, "/"), "/", "-") + "."
+}
+
+// rewriteSetCookies scopes the cookies an upstream sets to its route, so
+// two apps that both use Path=/ (e.g. two Jupyter servers) keep separate
+// sessions. With --cookie-namespace the names are prefixed per route too.
+func (p *Proxy) rewriteSetCookies(resp *http.Response, prefix string) {
+	values := resp.Header.Values("Set-Cookie")
+	if len(values) == 0 {
+		return
+	}
+	namespace := ""
+	if p.cookieNamespace {
+		namespace = cookieNamespace(prefix)
+	}
+	rewritten := make([]string, len(values))
+	for i, v := range values {
+		rewritten[i] = rewriteSetCookie(v, prefix, namespace)
+	}
+	resp.Header["Set-Cookie"] = rewritten
+	if p.verbose {
+		log.Printf("Rewrote %d Set-Cookie header(s) for %s", len(values), prefix)
+	}
+}
+
+// rewriteSetCookie rewrites one Set-Cookie value: the Path moves under
+// prefix, Domain is dropped (the browser only ever sees the manager's
+// host), and the name gains namespace if non-empty. Other attributes are
+// kept as written.
+func rewriteSetCookie(value, prefix, namespace string) string {
+	parts := strings.Split(value, ";")
+	name := strings.TrimSpace(parts[0])
+	if namespace != "" && name != "" {
+		name = namespace + name
+	}
+	// __Host- cookies must keep Path=/ or the browser rejects them; once
+	// namespaced they are ordinary cookies and can be scoped
+	scopePath := !strings.HasPrefix(name, "__Host-")
+
+	out := []string{name}
+	for _, attr := range parts[1:] {
+		key, val, _ := strings.Cut(strings.TrimSpace(attr), "=")
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "":
+			continue
+		case "domain":
+			continue
+		case "path":
+			val = strings.TrimSpace(val)
+			if scopePath && strings.HasPrefix(val, "/") && !isRoutedPath(val, prefix) {
+				if val == "/" {
+					// Without a trailing slash the cookie also matches the bare prefix
+					val = ""
+				}
+				attr = " Path=" + prefix + val
+			}
+		}
+		out = append(out, attr)
+	}
+	return strings.Join(out, ";")
+}
+
+// stripCookieNamespace removes namespace from the request's cookie names
+// and withholds cookies namespaced for other routes. Cookies without a
+// namespace, e.g. set by page scripts, pass through unchanged.
+func stripCookieNamespace(r *http.Request, namespace string) {
+	values := r.Header.Values("Cookie")
+	if len(values) == 0 {
+		return
+	}
+	var kept []string
+	for _, line := range values {
+		for _, part := range strings.Split(line, ";") {
+			part = strings.TrimSpace(part)
+			switch {
+			case part == "":
+				continue
+			case strings.HasPrefix(part, namespace):
+				part = strings.TrimPrefix(part, namespace)
+			case strings.HasPrefix(part, cookieNamespaceMarker):
+				continue
+			}
+			kept = append(kept, part)
+		}
+	}
+	if len(kept) == 0 {
+		r.Header.Del("Cookie")
+		return
+	}
+	r.Header.Set("Cookie", strings.Join(kept, "; "))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRewriteSetCookie(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     string
+		namespace string
+		want      string
+	}{
+		{"root path", "sid=abc; Path=/; HttpOnly", "", "sid=abc; Path=/port/5500; HttpOnly"},
+		{"sub path", "sid=abc; path=/lab", "", "sid=abc; Path=/port/5500/lab"},
+		{"already routed", "sid=abc; Path=/port/5500/lab", "", "sid=abc; Path=/port/5500/lab"},
+		{"no path", "sid=abc; Max-Age=60", "", "sid=abc; Max-Age=60"},
+		{"domain dropped", "sid=abc; Domain=localhost; Path=/", "", "sid=abc; Path=/port/5500"},
+		{"attributes kept", "sid=abc; Path=/; Secure; SameSite=Lax; Partitioned", "", "sid=abc; Path=/port/5500; Secure; SameSite=Lax; Partitioned"},
+		{"host prefix keeps root path", "__Host-sid=abc; Path=/; Secure", "", "__Host-sid=abc; Path=/; Secure"},
+		{"namespaced", "sid=abc; Path=/", "hpc.port-5500.", "hpc.port-5500.sid=abc; Path=/port/5500"},
+		{"namespaced host prefix is scoped", "__Host-sid=abc; Path=/; Secure", "hpc.port-5500.", "hpc.port-5500.__Host-sid=abc; Path=/port/5500; Secure"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewriteSetCookie(tt.value, "/port/5500", tt.namespace); got != tt.want {
+				t.Errorf("rewriteSetCookie(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteResponseSetCookies(t *testing.T) {
+	p := NewProxy(0, false, false)
+	resp := &http.Response{
+		Header: http.Header{
+			"Content-Type": []string{"application/json"},
+			"Set-Cookie": []string{
+				"_xsrf=1; Path=/",
+				"username-localhost-8888=2; Domain=127.0.0.1; Path=/; HttpOnly",
+				"theme=dark",
+			},
+		},
+		Body: io.NopCloser(strings.NewReader("{}")),
+	}
+	if err := p.rewriteResponse(resp, 8888, "/port/8888/"); err != nil {
+		t.Fatalf("rewriteResponse() error = %v", err)
+	}
+	want := []string{
+		"_xsrf=1; Path=/port/8888",
+		"username-localhost-8888=2; Path=/port/8888; HttpOnly",
+		"theme=dark",
+	}
+	if got := resp.Header.Values("Set-Cookie"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Set-Cookie = %q, want %q", got, want)
+	}
+}
+
+func TestStripCookieNamespace(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Add("Cookie", "hpc.port-5500.sid=a; hpc.port-8888.sid=b")
+	req.Header.Add("Cookie", "theme=dark")
+	stripCookieNamespace(req, "hpc.port-5500.")
+	if got := req.Header.Get("Cookie"); got != "sid=a; theme=dark" {
+		t.Errorf("Cookie = %q, want %q", got, "sid=a; theme=dark")
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Cookie", "hpc.port-8888.sid=b")
+	stripCookieNamespace(req, "hpc.port-5500.")
+	if got := req.Header.Values("Cookie"); got != nil {
+		t.Errorf("Cookie = %q, want none", got)
+	}
+}
+
+func TestProxyCookieNamespace(t *testing.T) {
+	var gotCookie string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotCookie = r.Header.Get("Cookie")
+		http.SetCookie(w, &http.Cookie{Name: "sid", Value: "new", Path: "/"})
+	}))
+	defer backend.Close()
+	backendPort := strings.TrimPrefix(backend.URL, "http://127.0.0.1:")
+	namespace := cookieNamespace("/port/" + backendPort)
+
+	p := NewProxy(0, false, false)
+	p.ownerCheck = false
+	p.cookieNamespace = true
+
+	req := httptest.NewRequest("GET", "/port/"+backendPort+"/", nil)
+	req.Header.Set("Cookie", namespace+"sid=old; hpc.port-1.sid=other")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if gotCookie != "sid=old" {
+		t.Errorf("upstream Cookie = %q, want %q", gotCookie, "sid=old")
+	}
+	want := namespace + "sid=new; Path=/port/" + backendPort
+	if got := w.Header().Get("Set-Cookie"); got != want {
+		t.Errorf("Set-Cookie = %q, want %q", got, want)
+	}
+}
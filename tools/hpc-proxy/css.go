@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+)
+
+// cssHoldLimit caps how much stylesheet text is held back waiting for a
+// rule boundary before it is rewritten anyway
+const cssHoldLimit = 64 << 10
+
+// cssURLPattern matches the start of a root-relative url() or quoted
+// @import reference. Quotes may be entity-encoded inside style attributes.
+// Captures: $1 = everything before the path, $2 = the path
+var cssURLPattern = regexp.MustCompile(`(?i)((?:url\(\s*|@import\s+)(?:["']|&quot;|&#0*39;|&apos;)?)(/[^"'\s)]*)`)
+
+// rewriteCSS prefixes root-relative url() and @import references in css,
+// reporting whether anything changed
+func rewriteCSS(css, prefix string) (string, bool) {
+	changed := false
+	out := cssURLPattern.ReplaceAllStringFunc(css, func(match string) string {
+		parts := cssURLPattern.FindStringSubmatch(match)
+		path, ok := prefixURL(parts[2], prefix)
+		if !ok {
+			return match
+		}
+		changed = true
+		return parts[1] + path
+	})
+	return out, changed
+}
+
+// cssRewriter streams a stylesheet through rewriteCSS, cutting it at rule
+// boundaries so no reference is split between chunks
+type cssRewriter struct {
+	r       io.Reader
+	body    io.Closer
+	prefix  string
+	buf     []byte
+	pending []byte
+	out     bytes.Buffer
+	err     error
+}
+
+// newCSSRewriter rewrites the stylesheet read from r. body is closed with
+// the rewriter.
+func newCSSRewriter(r io.Reader, body io.Closer, prefix string) *cssRewriter {
+	return &cssRewriter{
+		r:      r,
+		body:   body,
+		prefix: prefix,
+		buf:    make([]byte, 32<<10),
+	}
+}
+
+func (cr *cssRewriter) Read(p []byte) (int, error) {
+	for cr.out.Len() == 0 && cr.err == nil {
+		cr.fill()
+	}
+	if cr.out.Len() > 0 {
+		return cr.out.Read(p)
+	}
+	return 0, cr.err
+}
+
+func (cr *cssRewriter) Close() error {
+	return cr.body.Close()
+}
+
+// fill reads the next chunk and rewrites everything up to the last rule
+// boundary in what is pending
+func (cr *cssRewriter) fill() {
+	n, err := cr.r.Read(cr.buf)
+	cr.pending = append(cr.pending, cr.buf[:n]...)
+	if err != nil {
+		cr.flush(len(cr.pending))
+		cr.err = err
+		return
+	}
+
+	cut := bytes.LastIndexAny(cr.pending, "};\n") + 1
+	if cut == 0 {
+		if len(cr.pending) < cssHoldLimit {
+			return
+		}
+		cut = len(cr.pending)
+	}
+	cr.flush(cut)
+}
+
+// flush rewrites the first n pending bytes into the output
+func (cr *cssRewriter) flush(n int) {
+	css, _ := rewriteCSS(string(cr.pending[:n]), cr.prefix)
+	cr.out.WriteString(css)
+	cr.pending = append(cr.pending[:0], cr.pending[n:]...)
+}
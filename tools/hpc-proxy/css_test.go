@@ -0,0 +1,124 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestRewriteCSS(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"unquoted url", `src: url(/fonts/x.woff)`, `src: url(/port/5500/fonts/x.woff)`},
+		{"double-quoted url", `background: url("/img/bg.png")`, `background: url("/port/5500/img/bg.png")`},
+		{"single-quoted url with spaces", `background: URL( '/img/bg.png' )`, `background: URL( '/port/5500/img/bg.png' )`},
+		{"quoted import", `@import "/base.css";`, `@import "/port/5500/base.css";`},
+		{"import url", `@import url('/base.css') screen;`, `@import url('/port/5500/base.css') screen;`},
+		{"relative url untouched", `url(img/bg.png)`, `url(img/bg.png)`},
+		{"protocol-relative untouched", `url(//cdn.example.com/x.css)`, `url(//cdn.example.com/x.css)`},
+		{"absolute URL untouched", `@import "https://fonts.example.com/css";`, `@import "https://fonts.example.com/css";`},
+		{"data URI untouched", `url(data:image/svg+xml;base64,AAAA)`, `url(data:image/svg+xml;base64,AAAA)`},
+		{"already prefixed", `url(/port/5500/x.png)`, `url(/port/5500/x.png)`},
+		{"entity-quoted in attribute", `background:url(&quot;/bg.png&quot;)`, `background:url(&quot;/port/5500/bg.png&quot;)`},
+		{"several references", `a{b:url(/1.png)}c{d:url(/2.png)}`, `a{b:url(/port/5500/1.png)}c{d:url(/port/5500/2.png)}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := rewriteCSS(tt.input, "/port/5500")
+			if got != tt.want {
+				t.Errorf("rewriteCSS(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCSSRewriterChunks(t *testing.T) {
+	css := strings.Repeat("@font-face{src:url(/fonts/a.woff2) format('woff2')}\n.x{background:url( \"/img/b.png\" )}", 200)
+	want, _ := rewriteCSS(css, "/port/5500")
+
+	// Reading a byte at a time must not split any reference
+	cr := newCSSRewriter(iotest.OneByteReader(strings.NewReader(css)), io.NopCloser(nil), "/port/5500")
+	got, err := io.ReadAll(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("chunked rewrite differs from whole rewrite")
+	}
+}
+
+func TestRewriteHTMLInlineCSS(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "style block",
+			input: `<style>@import "/theme.css"; body{background:url(/bg.png)}</style>`,
+			want:  `<style>@import "/port/5500/theme.css"; body{background:url(/port/5500/bg.png)}</style>`,
+		},
+		{
+			name:  "style attribute",
+			input: `<div style="background-image: url('/hero.jpg')">`,
+			want:  `<div style="background-image: url('/port/5500/hero.jpg')">`,
+		},
+		{
+			name:  "style attribute with entity quotes",
+			input: `<div style="background:url(&quot;/hero.jpg&quot;)">`,
+			want:  `<div style="background:url(&quot;/port/5500/hero.jpg&quot;)">`,
+		},
+		{
+			name:  "script text untouched",
+			input: `<script>el.style.background = "url(/x.png)"</script>`,
+			want:  `<script>el.style.background = "url(/x.png)"</script>`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rewriteHTMLString(t, tt.input, "/port/5500", "")
+			if got != tt.want {
+				t.Errorf("rewrite(%q)\n got %q\nwant %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteResponseCSSGzipped(t *testing.T) {
+	p := NewProxy(0, true, false)
+
+	var buf strings.Builder
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte(`body{background:url(/bg.png)}`))
+	gw.Close()
+
+	resp := &http.Response{
+		Header: http.Header{
+			"Content-Type":     []string{"text/css; charset=utf-8"},
+			"Content-Encoding": []string{"gzip"},
+			"Content-Length":   []string{"42"},
+		},
+		ContentLength: 42,
+		Body:          io.NopCloser(strings.NewReader(buf.String())),
+	}
+
+	if err := p.rewriteResponse(resp, 5500, "/port/5500/css/site.css"); err != nil {
+		t.Fatalf("rewriteResponse() error = %v", err)
+	}
+	if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Length") != "" || resp.ContentLength != -1 {
+		t.Errorf("expected decoded body of unknown length, got headers %v", resp.Header)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != `body{background:url(/port/5500/bg.png)}` {
+		t.Errorf("unexpected body: %s", body)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	_ "embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// failureKind classifies why a routed request could not be served
+type failureKind string
+
+const (
+	failNotListening failureKind = "not_listening"  // connection refused, socket missing
+	failNotOwned     failureKind = "not_owned"      // another user's port or socket
+	failOwnerUnknown failureKind = "owner_unknown"  // ownership could not be checked
+	failTimeout      failureKind = "timeout"        // no answer in time
+	failTLS          failureKind = "tls_upstream"   // HTTPS service on a plain-HTTP route
+	failNotTLS       failureKind = "not_tls"        // plain-HTTP service on an HTTPS route
+	failCertChanged  failureKind = "cert_changed"   // certificate differs from the pinned one
+	failReset        failureKind = "upstream_reset" // connection closed before the response
+	failRewrite      failureKind = "rewrite_failed" // the response could not be rewritten
+	failUpstream     failureKind = "upstream_error" // anything else
+)
+
+// tlsProbeTimeout bounds the handshake used to tell whether a failing
+// upstream speaks TLS
+const tlsProbeTimeout = 500 * time.Millisecond
+
+var (
+	// errOwnerUnknown wraps failures to read the socket tables
+	errOwnerUnknown = errors.New("cannot verify port owner")
+
+	// errTLSUpstream reports a TLS service answering plain HTTP
+	errTLSUpstream = errors.New("upstream expects TLS")
+)
+
+// goTLSMismatch starts the reply of Go TLS servers to plain HTTP requests
+var goTLSMismatch = []byte("Client sent an HTTP request to an HTTPS server")
+
+// rewriteError marks a failure in response rewriting, as opposed to one
+// reaching the upstream
+type rewriteError struct {
+	Err error
+}
+
+func (e *rewriteError) Error() string {
+	return "rewrite response: " + e.Err.Error()
+}
+
+func (e *rewriteError) Unwrap() error {
+	return e.Err
+}
+
+//go:embed templates/error.html
+var errorHTML string
+
+// errorTemplate renders diagnostic error pages
+var errorTemplate = template.Must(template.New("error").Parse(errorHTML))
+
+// fixStep is one suggestion on an error page, optionally with a command
+type fixStep struct {
+	Text    string `json:"text"`
+	Command string `json:"command,omitempty"`
+}
+
+// upstreamFailure describes a failed request: the HTML error page's view
+// model and the JSON body sent to non-browser clients
+type upstreamFailure struct {
+	Kind   failureKind `json:"error"`
+	Status int         `json:"status"`
+	Target string      `json:"target"`
+	Title  string      `json:"title"`
+	Cause  string      `json:"cause"`
+	Tried  []string    `json:"tried,omitempty"`
+	Fix    []fixStep   `json:"fix,omitempty"`
+	Detail string      `json:"detail,omitempty"`
+}
+
+// classifyFailure works out the likely cause of a proxy error
+func classifyFailure(err error) failureKind {
+	var rerr *rewriteError
+	var nerr net.Error
+	var rherr tls.RecordHeaderError
+	msg := err.Error()
+	switch {
+	case errors.As(err, &rerr):
+		return failRewrite
+	case errors.Is(err, errCertChanged):
+		return failCertChanged
+	case errors.As(err, &rherr):
+		return failNotTLS
+	case errors.Is(err, errTLSUpstream),
+		// Plain HTTP answered with a TLS alert or handshake record
+		strings.Contains(msg, `malformed HTTP response "\x15\x03`),
+		strings.Contains(msg, `malformed HTTP response "\x16\x03`):
+		return failTLS
+	case errors.Is(err, errPortNotOwned):
+		return failNotOwned
+	case errors.Is(err, errOwnerUnknown):
+		return failOwnerUnknown
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, os.ErrNotExist):
+		return failNotListening
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &nerr) && nerr.Timeout():
+		return failTimeout
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return failReset
+	}
+	return failUpstream
+}
+
+// probeTLS reports whether addr completes a TLS handshake
+func probeTLS(addr string) bool {
+	dialer := &net.Dialer{Timeout: tlsProbeTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// detectTLSUpstream recognises the 400 that Go TLS servers send back to
+// plain HTTP, which otherwise reaches the browser as a bare error
+func detectTLSUpstream(resp *http.Response) error {
+	if resp.StatusCode != http.StatusBadRequest || resp.ProtoAtLeast(1, 1) {
+		return nil
+	}
+	br := bufio.NewReaderSize(resp.Body, 64)
+	head, _ := br.Peek(len(goTLSMismatch))
+	if bytes.Equal(head, goTLSMismatch) {
+		return errTLSUpstream
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, resp.Body}
+	return nil
+}
+
+// diagnose turns a failure reaching target into an error page naming the
+// likely cause, the addresses tried and what to run about it
+func (p *Proxy) diagnose(target upstreamTarget, err error) upstreamFailure {
+	kind := classifyFailure(err)
+	if (kind == failReset || kind == failUpstream) && !target.tls && target.socketPath == "" && target.host != "" && probeTLS(target.host) {
+		kind = failTLS
+	}
+
+	f := upstreamFailure{
+		Kind:   kind,
+		Status: http.StatusBadGateway,
+		Detail: err.Error(),
+	}
+	var uerr *upstreamError
+	switch {
+	case errors.As(err, &uerr):
+		f.Tried = uerr.Tried
+	case target.socketPath != "":
+		f.Tried = []string{target.socketPath}
+	case target.host != "":
+		f.Tried = []string{target.host}
+	}
+
+	if target.socketPath != "" {
+		p.describeSocketFailure(&f, filepath.Base(target.socketPath), target.socketPath)
+	} else {
+		p.describePortFailure(&f, target.port, target.tls)
+	}
+	return f
+}
+
+// describePortFailure fills in the explanation for a TCP port, reached
+// over HTTPS when secure is set
+func (p *Proxy) describePortFailure(f *upstreamFailure, port int, secure bool) {
+	f.Target = fmt.Sprintf("port %d", port)
+	listening := fixStep{"See what is listening on the port:", fmt.Sprintf("ss -ltnp 'sport = :%d'", port)}
+	direct := fixStep{"Try it without the proxy, from the node:", fmt.Sprintf("curl -v http://127.0.0.1:%d/", port)}
+	if secure {
+		direct.Command = fmt.Sprintf("curl -kv https://127.0.0.1:%d/", port)
+	}
+
+	switch f.Kind {
+	case failNotListening:
+		f.Title = fmt.Sprintf("Nothing is listening on port %d", port)
+		f.Cause = "Every address tried refused the connection. The service has not started yet, has exited, or listens on another port or on an address the proxy does not try."
+		f.Fix = []fixStep{
+			listening,
+			{Text: "Start the service on this port, listening on 127.0.0.1 or 0.0.0.0, and reload. If it is still starting, wait and reload."},
+		}
+	case failNotOwned:
+		f.Status = http.StatusForbidden
+		f.Title = fmt.Sprintf("Port %d belongs to another user", port)
+		f.Cause = "The process listening on this port runs as a different user. On a shared node the proxy only exposes your own services."
+		f.Fix = []fixStep{
+			{Text: "Start your own copy of the service on a free port and open that one. Ports already taken:", Command: "ss -ltn"},
+		}
+	case failOwnerUnknown:
+		f.Status = http.StatusForbidden
+		f.Title = fmt.Sprintf("Cannot verify who owns port %d", port)
+		f.Cause = "The proxy could not read the socket tables under /proc/net, so it cannot check that the port is yours."
+		f.Fix = []fixStep{
+			listening,
+			{Text: "If /proc is not readable inside the container, restart the proxy with --skip-owner-check (only on nodes you do not share)."},
+		}
+	case failTimeout:
+		f.Status = http.StatusGatewayTimeout
+		f.Title = fmt.Sprintf("Port %d did not answer in time", port)
+		f.Cause = "The service did not respond in time. It is usually busy, e.g. a long computation blocking a single-threaded R or Python process, or a firewall drops connections to the address tried."
+		f.Fix = []fixStep{
+			{Text: "Check whether the service is busy:", Command: `top -u "$USER"`},
+			direct,
+		}
+	case failTLS:
+		f.Title = fmt.Sprintf("Port %d expects HTTPS", port)
+		f.Cause = "The service speaks TLS (e.g. started with --certfile or an SSL option), but /port routes talk plain HTTP to it."
+		f.Fix = []fixStep{
+			{Text: fmt.Sprintf("Open it through the HTTPS route instead: %s/sport/%d/", p.externalPrefix, port)},
+			{Text: "Confirm it answers HTTPS:", Command: fmt.Sprintf("curl -kI https://127.0.0.1:%d/", port)},
+		}
+	case failNotTLS:
+		f.Title = fmt.Sprintf("Port %d does not speak HTTPS", port)
+		f.Cause = "The service answered the TLS handshake with plain HTTP, so /sport is the wrong route for it."
+		f.Fix = []fixStep{
+			{Text: fmt.Sprintf("Open it through the plain route instead: %s/port/%d/", p.externalPrefix, port)},
+		}
+	case failCertChanged:
+		f.Title = fmt.Sprintf("Port %d presented a different certificate", port)
+		f.Cause = "The HTTPS service on this port no longer presents the certificate the proxy pinned when it first connected. Either the service was restarted with a new self-signed certificate while the proxy kept running, or a different process now holds the port."
+		f.Fix = []fixStep{
+			{Text: "Check the certificate the service presents now:", Command: fmt.Sprintf("openssl s_client -connect 127.0.0.1:%d </dev/null 2>/dev/null | openssl x509 -noout -subject -fingerprint -sha256", port)},
+			{Text: "If the change is expected, stop the service until the proxy notices the port is closed (about a minute) and start it again, or restart the proxy. --upstream-tls=skip disables pinning."},
+		}
+	case failReset:
+		f.Title = fmt.Sprintf("Port %d closed the connection", port)
+		f.Cause = "The service accepted the connection but closed it before sending a complete response. It may have crashed, been killed for using too much memory, or failed on this request."
+		f.Fix = []fixStep{
+			{Text: "Check the service is still running:", Command: `ps -u "$USER" -o pid,etime,rss,args`},
+			direct,
+		}
+	case failRewrite:
+		f.Title = fmt.Sprintf("The response from port %d could not be rewritten", port)
+		f.Cause = "The service answered, but the proxy failed while rewriting its URLs for path-based routing."
+		f.Fix = []fixStep{
+			{Text: fmt.Sprintf("If the app can be told its base path, open it at %s/absport/%d/ instead, which leaves bodies alone.", p.externalPrefix, port)},
+			{Text: "Check the encoding the service sends:", Command: fmt.Sprintf("curl -sI -H 'Accept-Encoding: gzip' http://127.0.0.1:%d/", port)},
+		}
+	default:
+		f.Title = fmt.Sprintf("Service on port %d unavailable", port)
+		f.Cause = "The request to the service failed."
+		f.Fix = []fixStep{listening, direct}
+	}
+}
+
+// describeSocketFailure fills in the explanation for a Unix socket
+func (p *Proxy) describeSocketFailure(f *upstreamFailure, name, path string) {
+	f.Target = "socket " + name
+	direct := fixStep{"Try it without the proxy:", fmt.Sprintf("curl -v --unix-socket %s http://localhost/", path)}
+
+	switch f.Kind {
+	case failNotListening:
+		f.Title = fmt.Sprintf("Nothing is listening on socket %s", name)
+		f.Cause = "The socket file is missing or nothing accepts connections on it. The service has not started yet or has exited."
+		f.Fix = []fixStep{
+			{Text: "List the sockets in the socket directory:", Command: "ls -l " + filepath.Dir(path)},
+			{Text: "Start the service bound to this socket and reload."},
+		}
+	case failNotOwned:
+		f.Status = http.StatusForbidden
+		f.Title = fmt.Sprintf("Socket %s belongs to another user", name)
+		f.Cause = "The socket file is owned by a different user. On a shared node the proxy only exposes your own services."
+		f.Fix = []fixStep{{Text: "Start your own copy of the service on a socket of your own."}}
+	case failTimeout:
+		f.Status = http.StatusGatewayTimeout
+		f.Title = fmt.Sprintf("Socket %s did not answer in time", name)
+		f.Cause = "The service did not respond in time; it is probably busy."
+		f.Fix = []fixStep{{Text: "Check whether the service is busy:", Command: `top -u "$USER"`}, direct}
+	case failReset:
+		f.Title = fmt.Sprintf("Socket %s closed the connection", name)
+		f.Cause = "The service accepted the connection but closed it before sending a complete response. It may have crashed or failed on this request."
+		f.Fix = []fixStep{{Text: "Check the service is still running:", Command: `ps -u "$USER" -o pid,etime,rss,args`}, direct}
+	case failRewrite:
+		f.Title = fmt.Sprintf("The response from socket %s could not be rewritten", name)
+		f.Cause = "The service answered, but the proxy failed while rewriting its URLs for path-based routing."
+		f.Fix = []fixStep{direct}
+	default:
+		f.Title = fmt.Sprintf("Socket %s unavailable", name)
+		f.Cause = "The request to the service failed."
+		f.Fix = []fixStep{direct}
+	}
+}
+
+// wantsHTML reports whether the client is a browser expecting a page
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// serveFailure writes a diagnostic error: an HTML page for browsers, JSON
+// for scripts and API clients
+func (p *Proxy) serveFailure(w http.ResponseWriter, r *http.Request, f upstreamFailure) {
+	if !wantsHTML(r) {
+		writeJSON(w, f.Status, f)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(f.Status)
+	if err := errorTemplate.Execute(w, f); err != nil {
+		log.Printf("Failed to render error page: %v", err)
+	}
+}
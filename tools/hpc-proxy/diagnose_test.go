@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want failureKind
+	}{
+		{"refused", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, failNotListening},
+		{"resolver refused", &upstreamError{Port: 3838, Tried: []string{"127.0.0.1:3838"}, Err: syscall.ECONNREFUSED}, failNotListening},
+		{"socket missing", &os.PathError{Op: "stat", Path: "/tmp/app.sock", Err: syscall.ENOENT}, failNotListening},
+		{"not owned", errPortNotOwned, failNotOwned},
+		{"owner unknown", fmt.Errorf("%w: read socket table", errOwnerUnknown), failOwnerUnknown},
+		{"dial timeout", &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, failTimeout},
+		{"context deadline", context.DeadlineExceeded, failTimeout},
+		{"TLS alert", errors.New(`net/http: HTTP/1.x transport connection broken: malformed HTTP response "\x15\x03\x01\x00\x02\x02P"`), failTLS},
+		{"Go TLS server", errTLSUpstream, failTLS},
+		{"reset", &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, failReset},
+		{"EOF", io.EOF, failReset},
+		{"rewrite", &rewriteError{Err: errors.New("decode gzip: invalid header")}, failRewrite},
+		{"other", errors.New("something else"), failUpstream},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyFailure(tt.err); got != tt.want {
+				t.Errorf("classifyFailure(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// rawBackend listens on loopback and hands each connection to serve
+func rawBackend(t *testing.T, serve func(conn net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return fmt.Sprint(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func TestProxyFailurePages(t *testing.T) {
+	refusedPort := fmt.Sprint(unusedPort(t))
+
+	tlsBackend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsBackend.Close()
+	tlsPort := strings.TrimPrefix(tlsBackend.URL, "https://127.0.0.1:")
+
+	// Answers plain HTTP with a TLS alert, like OpenSSL-based servers
+	alertPort := rawBackend(t, func(conn net.Conn) {
+		http.ReadRequest(bufio.NewReader(conn))
+		conn.Write([]byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x50})
+	})
+
+	// Reads the request and hangs up without answering
+	resetPort := rawBackend(t, func(conn net.Conn) {
+		http.ReadRequest(bufio.NewReader(conn))
+	})
+
+	corruptGzip := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write([]byte("\x1f\x8b\x00not really gzip"))
+	}))
+	defer corruptGzip.Close()
+	corruptPort := strings.TrimPrefix(corruptGzip.URL, "http://127.0.0.1:")
+
+	tests := []struct {
+		name       string
+		port       string
+		wantStatus int
+		wantKind   failureKind
+		wantFix    string
+	}{
+		{"connection refused", refusedPort, http.StatusBadGateway, failNotListening, "ss -ltnp 'sport = :" + refusedPort + "'"},
+		{"Go TLS server", tlsPort, http.StatusBadGateway, failTLS, "curl -kI https://127.0.0.1:" + tlsPort + "/"},
+		{"TLS alert", alertPort, http.StatusBadGateway, failTLS, "curl -kI https://127.0.0.1:" + alertPort + "/"},
+		{"reset", resetPort, http.StatusBadGateway, failReset, "curl -v http://127.0.0.1:" + resetPort + "/"},
+		{"rewrite failure", corruptPort, http.StatusBadGateway, failRewrite, "/absport/" + corruptPort + "/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProxy(0, true, false)
+			p.ownerCheck = false
+			p.upstreams.hosts = func() []string { return []string{"127.0.0.1"} }
+
+			// API clients get JSON
+			req := httptest.NewRequest("GET", "/port/"+tt.port+"/", nil)
+			req.Header.Set("Accept", "application/json")
+			req.Header.Set("Accept-Encoding", "gzip")
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			var f upstreamFailure
+			if err := json.Unmarshal(w.Body.Bytes(), &f); err != nil {
+				t.Fatalf("invalid JSON error: %v: %s", err, w.Body.String())
+			}
+			if f.Kind != tt.wantKind {
+				t.Errorf("kind = %q, want %q (detail %q)", f.Kind, tt.wantKind, f.Detail)
+			}
+			if len(f.Tried) == 0 || !strings.Contains(f.Tried[0], "127.0.0.1:"+tt.port) {
+				t.Errorf("expected tried addresses, got %v", f.Tried)
+			}
+
+			// Browsers get a page with the same diagnosis
+			p.startupWait = 0
+			req.Header.Set("Accept", "text/html")
+			w = httptest.NewRecorder()
+			p.ServeHTTP(w, req)
+
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+				t.Fatalf("expected HTML page, got %q", ct)
+			}
+			body := w.Body.String()
+			if !strings.Contains(body, f.Title) || !strings.Contains(body, html.EscapeString(tt.wantFix)) {
+				t.Errorf("expected title %q and fix %q in page, got: %s", f.Title, tt.wantFix, body)
+			}
+		})
+	}
+}
+
+func TestProxyForeignPortPage(t *testing.T) {
+	// 0.0.0.0:3838 LISTEN uid 2000
+	tcp := "   0: 00000000:0EFE 00000000:0000 0A 00000000:00000000 00:00000000 00000000  2000        0 1002 1 0000000000000000 100 0 0 10 0\n"
+
+	p := NewProxy(0, false, false)
+	p.uid = 1000
+	p.procfs = procFS{root: writeFakeProc(t, tcp, "")}
+
+	req := httptest.NewRequest("GET", "/port/3838/", nil)
+	req.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "Port 3838 belongs to another user") {
+		t.Errorf("expected 403 page naming the cause, got %d: %s", w.Code, w.Body.String())
+	}
+}
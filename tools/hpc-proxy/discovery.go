@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// discoveryInfo is the JSON document written to --discovery-file so the
+// manager can find the proxy and tell whether the file is stale
+type discoveryInfo struct {
+	Port       int       `json:"port"`
+	Hostname   string    `json:"hostname"`
+	PID        int       `json:"pid"`
+	UID        int       `json:"uid"`
+	Version    string    `json:"version"`
+	StartedAt  time.Time `json:"started_at"`
+	Token      string    `json:"token,omitempty"`
+	SlurmJobID string    `json:"slurm_job_id,omitempty"`
+}
+
+// newDiscoveryInfo collects discovery fields for the current process
+func newDiscoveryInfo(port int, token string) discoveryInfo {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = ""
+	}
+	return discoveryInfo{
+		Port:       port,
+		Hostname:   hostname,
+		PID:        os.Getpid(),
+		UID:        os.Getuid(),
+		Version:    version,
+		StartedAt:  time.Now().UTC().Truncate(time.Second),
+		Token:      token,
+		SlurmJobID: os.Getenv("SLURM_JOB_ID"),
+	}
+}
+
+// writeDiscoveryFile writes info as JSON with 0600 permissions, since it
+// may contain the auth token. It returns the bytes written, so the file
+// can later be removed only if it still holds them.
+func writeDiscoveryFile(path string, info discoveryInfo) ([]byte, error) {
+	data, err := info.encode()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// encode returns the JSON document written to the discovery file
+func (info discoveryInfo) encode() ([]byte, error) {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("encode discovery info: %w", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// writeFileAtomic writes data to a temp file in the target directory and
+// renames it into place, so readers never observe a partially written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("create directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	tmpName := tmp.Name()
+	// Best-effort cleanup if anything below fails; a no-op after rename
+	defer os.Remove(tmpName)
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("chmod temp file: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write temp file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp file: %w", err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteDiscoveryFile(t *testing.T) {
+	t.Setenv("SLURM_JOB_ID", "123456")
+	path := filepath.Join(t.TempDir(), "hpc-proxy", "proxy.json")
+
+	info := newDiscoveryInfo(9001, "secret")
+	written, err := writeDiscoveryFile(path, info)
+	if err != nil {
+		t.Fatalf("writeDiscoveryFile() error = %v", err)
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode().Perm() != 0600 {
+		t.Errorf("discovery file mode = %o, want 600", stat.Mode().Perm())
+	}
+
+	data, _ := os.ReadFile(path)
+	if string(data) != string(written) {
+		t.Errorf("writeDiscoveryFile() returned %q, file holds %q", written, data)
+	}
+	var got discoveryInfo
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", data, err)
+	}
+	if got.Port != 9001 || got.Token != "secret" || got.SlurmJobID != "123456" {
+		t.Errorf("unexpected discovery info: %+v", got)
+	}
+	if got.PID != os.Getpid() || got.Version != version || got.StartedAt.IsZero() {
+		t.Errorf("missing process fields: %+v", got)
+	}
+
+	// No temp files should be left behind
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("expected only the discovery file, found %d entries", len(entries))
+	}
+}
+
+func TestWriteFileAtomicReplaces(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "port")
+
+	if err := writeFileAtomic(path, []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(path, []byte("2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if string(data) != "2\n" {
+		t.Errorf("content = %q, want %q", data, "2\n")
+	}
+	stat, _ := os.Stat(path)
+	if stat.Mode().Perm() != 0600 {
+		t.Errorf("mode = %o, want 600", stat.Mode().Perm())
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// contentDecoders wrap a body in a decoder for one Content-Encoding token.
+// The encodings listed here are also the only ones advertised upstream
+// for routes whose bodies are rewritten.
+var contentDecoders = map[string]func(r *bufio.Reader) (io.ReadCloser, error){
+	"gzip":    newGzipDecoder,
+	"x-gzip":  newGzipDecoder,
+	"deflate": newDeflateDecoder,
+	"br": func(r *bufio.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(brotli.NewReader(r)), nil
+	},
+	"zstd": func(r *bufio.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	},
+}
+
+// errUnsupportedEncoding reports a Content-Encoding the proxy cannot decode
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// decodableEncodings is the Accept-Encoding preference order sent upstream
+var decodableEncodings = []string{"br", "zstd", "gzip", "deflate"}
+
+// newGzipDecoder decodes gzip. A body that does not start with the gzip
+// magic number is passed through as-is: some servers label plain bodies
+// as gzip.
+func newGzipDecoder(r *bufio.Reader) (io.ReadCloser, error) {
+	if magic, err := r.Peek(2); err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		return io.NopCloser(r), nil
+	}
+	return gzip.NewReader(r)
+}
+
+// newDeflateDecoder decodes "deflate", which RFC 9110 defines as zlib but
+// some servers send as a raw DEFLATE stream
+func newDeflateDecoder(r *bufio.Reader) (io.ReadCloser, error) {
+	if h, err := r.Peek(2); err == nil && h[0]&0x0f == 8 && (uint16(h[0])<<8|uint16(h[1]))%31 == 0 {
+		return zlib.NewReader(r)
+	}
+	return flate.NewReader(r), nil
+}
+
+// decodedBody reads a decoded body and closes the decoders with it
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (d *decodedBody) Close() error {
+	var first error
+	for _, c := range d.closers {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// decodeBody returns body decoded according to a Content-Encoding value,
+// undoing each listed coding in reverse order. It fails for encodings the
+// proxy cannot decode, leaving body unread.
+func decodeBody(encoding string, body io.ReadCloser) (io.ReadCloser, error) {
+	var tokens []string
+	for _, token := range strings.Split(encoding, ",") {
+		token = strings.ToLower(strings.TrimSpace(token))
+		if token == "" || token == "identity" {
+			continue
+		}
+		if contentDecoders[token] == nil {
+			return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, token)
+		}
+		tokens = append(tokens, token)
+	}
+
+	decoded := &decodedBody{Reader: body, closers: []io.Closer{body}}
+	for i := len(tokens) - 1; i >= 0; i-- {
+		d, err := contentDecoders[tokens[i]](bufio.NewReader(decoded.Reader))
+		if err != nil {
+			decoded.Close()
+			return nil, fmt.Errorf("decode %s: %w", tokens[i], err)
+		}
+		decoded.Reader = d
+		decoded.closers = append([]io.Closer{d}, decoded.closers...)
+	}
+	return decoded, nil
+}
+
+// decodableAcceptEncoding narrows a client's Accept-Encoding to codings
+// the proxy can decode, so bodies it rewrites never arrive in a format it
+// cannot read. It returns "" when nothing acceptable is left, in which
+// case the transport negotiates gzip itself and decodes it transparently.
+func decodableAcceptEncoding(accept string) string {
+	offered := make(map[string]bool)
+	for _, part := range strings.Split(accept, ",") {
+		token, params, _ := strings.Cut(part, ";")
+		token = strings.ToLower(strings.TrimSpace(token))
+		if acceptQ(params) == 0 {
+			continue
+		}
+		if token == "*" {
+			for _, e := range decodableEncodings {
+				offered[e] = true
+			}
+		}
+		if token == "x-gzip" {
+			token = "gzip"
+		}
+		offered[token] = true
+	}
+	var kept []string
+	for _, e := range decodableEncodings {
+		if offered[e] {
+			kept = append(kept, e)
+		}
+	}
+	return strings.Join(kept, ", ")
+}
+
+// acceptQ returns the q parameter of an Accept-Encoding entry, 1 if absent
+func acceptQ(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.EqualFold(key, "q") {
+			if q, err := strconv.ParseFloat(value, 64); err == nil {
+				return q
+			}
+		}
+	}
+	return 1
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// encoders compress test bodies for each supported Content-Encoding
+var encoders = map[string]func(w io.Writer) io.WriteCloser{
+	"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+	"deflate": func(w io.Writer) io.WriteCloser {
+		return zlib.NewWriter(w)
+	},
+	"br": func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+	"zstd": func(w io.Writer) io.WriteCloser {
+		enc, _ := zstd.NewWriter(w)
+		return enc
+	},
+}
+
+// encode compresses s with the named encoding
+func encode(t *testing.T, encoding, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := encoders[encoding](&buf)
+	if _, err := io.WriteString(w, s); err != nil {
+		t.Fatalf("encode %s: %v", encoding, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("encode %s: %v", encoding, err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeBody(t *testing.T) {
+	const text = "<html><head></head><body>hello</body></html>"
+
+	var rawDeflate bytes.Buffer
+	fw, _ := flate.NewWriter(&rawDeflate, flate.DefaultCompression)
+	fw.Write([]byte(text))
+	fw.Close()
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+	}{
+		{"identity", "", []byte(text)},
+		{"gzip", "gzip", encode(t, "gzip", text)},
+		{"x-gzip", "x-gzip", encode(t, "gzip", text)},
+		{"deflate zlib", "deflate", encode(t, "deflate", text)},
+		{"deflate raw", "deflate", rawDeflate.Bytes()},
+		{"brotli", "br", encode(t, "br", text)},
+		{"zstd", "zstd", encode(t, "zstd", text)},
+		{"mislabelled gzip", "gzip", []byte(text)},
+		{"chained", "gzip, br", encode(t, "br", string(encode(t, "gzip", text)))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := decodeBody(tt.encoding, io.NopCloser(bytes.NewReader(tt.body)))
+			if err != nil {
+				t.Fatalf("decodeBody(%q) error = %v", tt.encoding, err)
+			}
+			defer decoded.Close()
+			got, err := io.ReadAll(decoded)
+			if err != nil {
+				t.Fatalf("read decoded %q: %v", tt.encoding, err)
+			}
+			if string(got) != text {
+				t.Errorf("decodeBody(%q) = %q, want %q", tt.encoding, got, text)
+			}
+		})
+	}
+
+	if _, err := decodeBody("compress", io.NopCloser(strings.NewReader(""))); err == nil {
+		t.Errorf("decodeBody(compress) succeeded, want error")
+	}
+}
+
+func TestDecodableAcceptEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"gzip, deflate, br, zstd", "br, zstd, gzip, deflate"},
+		{"gzip, deflate", "gzip, deflate"},
+		{"br;q=1.0, gzip;q=0.8, *;q=0.1", "br, zstd, gzip, deflate"},
+		{"gzip;q=0, br", "br"},
+		{"compress, sdch", ""},
+		{"identity", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := decodableAcceptEncoding(tt.accept); got != tt.want {
+			t.Errorf("decodableAcceptEncoding(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestRewriteResponseEncoded(t *testing.T) {
+	p := NewProxy(0, true, false)
+	const page = `<html><head></head><body><a href="/foo">link</a></body></html>`
+
+	for encoding := range encoders {
+		t.Run(encoding, func(t *testing.T) {
+			resp := &http.Response{
+				Header: http.Header{
+					"Content-Type":     []string{"text/html"},
+					"Content-Encoding": []string{encoding},
+				},
+				Body: io.NopCloser(bytes.NewReader(encode(t, encoding, page))),
+			}
+			if err := p.rewriteResponse(resp, 5500, "/port/5500/"); err != nil {
+				t.Fatalf("rewriteResponse() error = %v", err)
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != "" {
+				t.Errorf("Content-Encoding = %q, want decoded body", got)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if !strings.Contains(string(body), `href="/port/5500/foo"`) {
+				t.Errorf("expected rewritten %s body, got: %s", encoding, body)
+			}
+		})
+	}
+}
+
+func TestRewriteResponseUnsupportedEncoding(t *testing.T) {
+	p := NewProxy(0, true, false)
+	body := []byte("\x1f\x9d\x90<html>")
+	resp := &http.Response{
+		Header: http.Header{
+			"Content-Type":     []string{"text/html"},
+			"Content-Encoding": []string{"compress"},
+		},
+		Body: io.NopCloser(bytes.NewReader(body)),
+	}
+	if err := p.rewriteResponse(resp, 5500, "/port/5500/"); err != nil {
+		t.Fatalf("rewriteResponse() error = %v", err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	if !bytes.Equal(got, body) || resp.Header.Get("Content-Encoding") != "compress" {
+		t.Errorf("unsupported encoding was modified: %q (%q)", got, resp.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestProxyNarrowsAcceptEncoding(t *testing.T) {
+	var gotAccept string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAccept = r.Header.Get("Accept-Encoding")
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head></head></html>`))
+	}))
+	defer backend.Close()
+	backendPort := strings.TrimPrefix(backend.URL, "http://127.0.0.1:")
+
+	tests := []struct {
+		name        string
+		baseRewrite bool
+		want        string
+	}{
+		{"rewritten port", true, "br, gzip"},
+		{"untouched port", false, "br, compress, gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProxy(0, tt.baseRewrite, false)
+			p.ownerCheck = false
+			req := httptest.NewRequest("GET", "/port/"+backendPort+"/", nil)
+			req.Header.Set("Accept-Encoding", "br, compress, gzip")
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, req)
+			if gotAccept != tt.want {
+				t.Errorf("upstream Accept-Encoding = %q, want %q", gotAccept, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Service identifiers reported by the ports API
+const (
+	serviceShiny      = "shiny"
+	serviceJupyter    = "jupyterlab"
+	serviceRStudio    = "rstudio"
+	serviceStreamlit  = "streamlit"
+	serviceGradio     = "gradio"
+	serviceDash       = "dash"
+	serviceVite       = "vite"
+	serviceLiveServer = "live-server"
+	serviceStatic     = "static"
+)
+
+// serviceInfo describes a recognised service and how the proxy treats it
+type serviceInfo struct {
+	ID   string
+	Name string
+	// Rewrite enables HTML body rewriting. Frameworks that build URLs in
+	// JavaScript from their own base-path setting are left alone, since
+	// rewriting their pages cannot help and the buffering only costs time.
+	Rewrite bool
+}
+
+var services = map[string]serviceInfo{
+	serviceShiny:      {serviceShiny, "Shiny", false},
+	serviceJupyter:    {serviceJupyter, "JupyterLab", false},
+	serviceRStudio:    {serviceRStudio, "RStudio", false},
+	serviceStreamlit:  {serviceStreamlit, "Streamlit", false},
+	serviceGradio:     {serviceGradio, "Gradio", false},
+	serviceDash:       {serviceDash, "Dash", true},
+	serviceVite:       {serviceVite, "Vite", true},
+	serviceLiveServer: {serviceLiveServer, "Live Server", true},
+	serviceStatic:     {serviceStatic, "Static server", true},
+}
+
+// fingerprintTTL bounds how long an identification is trusted, since a
+// port can be reused by a different server
+const fingerprintTTL = time.Minute
+
+// probeTimeout bounds the identifying request to an upstream
+const probeTimeout = time.Second
+
+// probeBodyLimit caps how much of the probed page is inspected
+const probeBodyLimit = 64 << 10
+
+// bodyMarkers are substrings of the root page that identify a framework,
+// checked in order (more specific first)
+var bodyMarkers = []struct {
+	marker  string
+	service string
+}{
+	{"/@vite/client", serviceVite},
+	{"Code injected by live-server", serviceLiveServer},
+	{"gradio_config", serviceGradio},
+	{"_dash-config", serviceDash},
+	{"_dash-renderer", serviceDash},
+	{"shiny.min.js", serviceShiny},
+	{"jupyter-config-data", serviceJupyter},
+	{"<title>Streamlit</title>", serviceStreamlit},
+	{"Directory listing for", serviceStatic},
+}
+
+// identifyResponse matches a probed root response against known markers
+func identifyResponse(header http.Header, body string) string {
+	server := strings.ToLower(header.Get("Server"))
+	location := header.Get("Location")
+
+	switch {
+	case strings.Contains(server, "rstudio") || strings.Contains(location, "auth-sign-in"):
+		return serviceRStudio
+	case strings.Contains(server, "tornado") && (strings.Contains(location, "/lab") || strings.Contains(location, "/tree")):
+		return serviceJupyter
+	case strings.Contains(server, "shiny"):
+		return serviceShiny
+	}
+
+	for _, m := range bodyMarkers {
+		if strings.Contains(body, m.marker) {
+			return m.service
+		}
+	}
+
+	// Python's http.server and npm http-server announce themselves
+	if strings.HasPrefix(server, "simplehttp") || strings.Contains(server, "http-server") {
+		return serviceStatic
+	}
+	return ""
+}
+
+// identifyCommand matches a process command line against known launchers
+func identifyCommand(command string) string {
+	cmd := strings.ToLower(command)
+	switch {
+	case cmd == "":
+		return ""
+	case strings.Contains(cmd, "shiny"):
+		return serviceShiny
+	case strings.Contains(cmd, "jupyter"):
+		return serviceJupyter
+	case strings.Contains(cmd, "rserver") || strings.Contains(cmd, "rstudio"):
+		return serviceRStudio
+	case strings.Contains(cmd, "streamlit"):
+		return serviceStreamlit
+	case strings.Contains(cmd, "gradio"):
+		return serviceGradio
+	case strings.Contains(cmd, "vite"):
+		return serviceVite
+	case strings.Contains(cmd, "live-server"):
+		return serviceLiveServer
+	case strings.Contains(cmd, "http.server") || strings.Contains(cmd, "http-server"):
+		return serviceStatic
+	}
+	return ""
+}
+
+// probeService fetches / from the upstream at addr and identifies it. ok
+// is false when the upstream did not answer, e.g. a busy single-threaded
+// app timing out, which says nothing about what it is. The probe goes
+// over the upstream transport, so it never takes an http_proxy detour.
+func (p *Proxy) probeService(addr string) (service string, ok bool) {
+	client := &http.Client{
+		Transport: p.transport,
+		Timeout:   probeTimeout,
+		// Redirect targets (e.g. Jupyter's /lab) are themselves a signal
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get("http://" + addr + "/")
+	if err != nil {
+		return "", false
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, probeBodyLimit))
+	return identifyResponse(resp.Header, string(body)), true
+}
+
+// fingerprintEntry is a cached identification for one port
+type fingerprintEntry struct {
+	service string
+	expires time.Time
+}
+
+// fingerprintCache remembers what runs on each port for fingerprintTTL.
+// Concurrent probes of one port are collapsed into a single request.
+type fingerprintCache struct {
+	mu      sync.Mutex
+	entries map[int]fingerprintEntry
+	probes  singleflight.Group
+}
+
+func newFingerprintCache() *fingerprintCache {
+	return &fingerprintCache{entries: make(map[int]fingerprintEntry)}
+}
+
+func (c *fingerprintCache) get(port int) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[port]
+	if !ok || time.Now().After(e.expires) {
+		return "", false
+	}
+	return e.service, true
+}
+
+func (c *fingerprintCache) set(port int, service string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[port] = fingerprintEntry{service: service, expires: time.Now().Add(fingerprintTTL)}
+}
+
+// probePort identifies the service on port from its response, then from
+// the command line of the process listening on it, sharing one probe
+// between concurrent callers. Only answered probes are cached: a port
+// that is not up yet or too busy to answer is retried next time.
+func (p *Proxy) probePort(port int) string {
+	service, _, _ := p.fingerprints.probes.Do(strconv.Itoa(port), func() (interface{}, error) {
+		addr, err := p.upstreams.resolve(port)
+		if err != nil {
+			return "", nil
+		}
+		service, ok := p.probeService(addr)
+		if !ok {
+			return "", nil
+		}
+		if service == "" {
+			service = identifyCommand(p.procfs.portCommand(port, p.uid))
+		}
+		p.fingerprints.set(port, service)
+		return service, nil
+	})
+	return service.(string)
+}
+
+// identifyService returns the service ID for port, probing the upstream
+// if needed and falling back to the owning command line. command may be
+// empty when the caller has not resolved it. It can block for up to
+// probeTimeout, so it is for the ports API, not the proxying path.
+func (p *Proxy) identifyService(port int, command string) string {
+	service, ok := p.fingerprints.get(port)
+	if !ok {
+		service = p.probePort(port)
+	}
+	if service == "" {
+		service = identifyCommand(command)
+	}
+	return service
+}
+
+// knownService returns the cached identification of port without
+// waiting. On a miss a probe starts in the background and the port counts
+// as unrecognised until it answers, so requests are never held up by
+// probing a busy app.
+func (p *Proxy) knownService(port int) string {
+	service, ok := p.fingerprints.get(port)
+	if !ok {
+		go p.probePort(port)
+	}
+	return service
+}
+
+// shouldRewriteHTML decides whether HTML bodies from port are rewritten.
+// With auto-rewrite on, recognised services use their own policy and
+// unrecognised ones, or ones not identified yet, fall back to
+// --base-rewrite.
+func (p *Proxy) shouldRewriteHTML(port int) bool {
+	if !p.autoRewrite {
+		return p.baseRewrite
+	}
+	if info, ok := services[p.knownService(port)]; ok {
+		return info.Rewrite
+	}
+	return p.baseRewrite
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdentifyResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		body   string
+		want   string
+	}{
+		{"vite", nil, `<script type="module" src="/@vite/client"></script>`, serviceVite},
+		{"live server", nil, `<!-- Code injected by live-server -->`, serviceLiveServer},
+		{"gradio", nil, `<script>window.gradio_config = {}</script>`, serviceGradio},
+		{"dash", nil, `<script id="_dash-config" type="application/json">`, serviceDash},
+		{"shiny", nil, `<script src="shared/shiny.min.js"></script>`, serviceShiny},
+		{"streamlit", nil, `<title>Streamlit</title>`, serviceStreamlit},
+		{"jupyter redirect", http.Header{"Server": {"TornadoServer/6.4"}, "Location": {"/lab?"}}, "", serviceJupyter},
+		{"jupyter page config", nil, `<script id="jupyter-config-data" type="application/json">`, serviceJupyter},
+		{"rstudio sign-in", http.Header{"Location": {"/auth-sign-in?appUri=%2F"}}, "", serviceRStudio},
+		{"python http.server", http.Header{"Server": {"SimpleHTTP/0.6 Python/3.12.1"}}, "<html>", serviceStatic},
+		{"directory listing", nil, "<title>Directory listing for /</title>", serviceStatic},
+		{"unknown", http.Header{"Server": {"nginx"}}, "<html><body>hi</body></html>", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := tt.header
+			if header == nil {
+				header = http.Header{}
+			}
+			if got := identifyResponse(header, tt.body); got != tt.want {
+				t.Errorf("identifyResponse() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdentifyCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"R -e shiny::runApp(port=3838)", serviceShiny},
+		{"/usr/bin/python3 /usr/local/bin/jupyter-lab --no-browser", serviceJupyter},
+		{"/usr/lib/rstudio-server/bin/rserver --www-port 8787", serviceRStudio},
+		{"python -m streamlit run app.py", serviceStreamlit},
+		{"node /home/u/app/node_modules/.bin/vite", serviceVite},
+		{"node /usr/bin/live-server --port=5500", serviceLiveServer},
+		{"python3 -m http.server 8000", serviceStatic},
+		{"python app.py", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			if got := identifyCommand(tt.command); got != tt.want {
+				t.Errorf("identifyCommand(%q) = %q, want %q", tt.command, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShouldRewriteHTML(t *testing.T) {
+	newBackend := func(body string) (*httptest.Server, int) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(body))
+		}))
+		return srv, srv.Listener.Addr().(*net.TCPAddr).Port
+	}
+
+	vite, vitePort := newBackend(`<html><head><script src="/@vite/client"></script></head></html>`)
+	defer vite.Close()
+	shiny, shinyPort := newBackend(`<html><head><script src="shared/shiny.min.js"></script></head></html>`)
+	defer shiny.Close()
+	plain, plainPort := newBackend(`<html><head></head></html>`)
+	defer plain.Close()
+
+	tests := []struct {
+		name        string
+		baseRewrite bool
+		autoRewrite bool
+		port        int
+		want        bool
+	}{
+		{"auto off uses global flag", true, false, shinyPort, true},
+		{"vite rewritten without global flag", false, true, vitePort, true},
+		{"shiny not rewritten despite global flag", true, true, shinyPort, false},
+		{"unknown falls back to global flag on", true, true, plainPort, true},
+		{"unknown falls back to global flag off", false, true, plainPort, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProxy(0, tt.baseRewrite, false)
+			p.autoRewrite = tt.autoRewrite
+			p.identifyService(tt.port, "")
+			if got := p.shouldRewriteHTML(tt.port); got != tt.want {
+				t.Errorf("shouldRewriteHTML() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAutoRewriteKeepsRedirects(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<html><head><script src="shared/shiny.min.js"></script></head><a href="/x">x</a></html>`))
+			return
+		}
+		http.Redirect(w, r, "/login", http.StatusFound)
+	}))
+	defer backend.Close()
+	backendPort := strings.TrimPrefix(backend.URL, "http://127.0.0.1:")
+
+	p := NewProxy(0, true, false)
+	p.autoRewrite = true
+	p.identifyService(backend.Listener.Addr().(*net.TCPAddr).Port, "")
+
+	// Shiny body is passed through untouched
+	req := httptest.NewRequest("GET", "/port/"+backendPort+"/", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if strings.Contains(w.Body.String(), "<base") || strings.Contains(w.Body.String(), "/port/") {
+		t.Errorf("expected Shiny HTML to be left alone, got: %s", w.Body.String())
+	}
+
+	// ...but redirects are still prefixed
+	req = httptest.NewRequest("GET", "/port/"+backendPort+"/private", nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if got := w.Header().Get("Location"); got != "/port/"+backendPort+"/login" {
+		t.Errorf("Location = %q, want prefixed redirect", got)
+	}
+}
+
+func TestShouldRewriteHTMLDoesNotWait(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head><script src="/@vite/client"></script></head></html>`))
+	}))
+	defer backend.Close()
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	p := NewProxy(0, false, false)
+	p.autoRewrite = true
+
+	start := time.Now()
+	if p.shouldRewriteHTML(port) {
+		t.Error("expected --base-rewrite while the service is not identified yet")
+	}
+	if elapsed := time.Since(start); elapsed > probeTimeout/2 {
+		t.Errorf("shouldRewriteHTML() waited %v for the probe", elapsed)
+	}
+
+	// The background probe identifies the port for later requests
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for !p.shouldRewriteHTML(port) {
+		if time.Now().After(deadline) {
+			t.Fatal("background probe never identified the service")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProbePortSingleFlight(t *testing.T) {
+	var probes atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte(`<html><head><script src="/@vite/client"></script></head></html>`))
+	}))
+	defer backend.Close()
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	p := NewProxy(0, false, false)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := p.identifyService(port, ""); got != serviceVite {
+				t.Errorf("identifyService() = %q, want %q", got, serviceVite)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := probes.Load(); n != 1 {
+		t.Errorf("expected concurrent lookups to share one probe, got %d", n)
+	}
+}
+
+func TestProbePortFailureNotCached(t *testing.T) {
+	// Reads the request and hangs up without answering
+	port, _ := strconv.Atoi(rawBackend(t, func(conn net.Conn) {
+		http.ReadRequest(bufio.NewReader(conn))
+	}))
+
+	p := NewProxy(0, false, false)
+	if got := p.identifyService(port, "python -m http.server"); got != serviceStatic {
+		t.Errorf("identifyService() = %q, want command line fallback %q", got, serviceStatic)
+	}
+	if _, ok := p.fingerprints.get(port); ok {
+		t.Error("failed probe was cached")
+	}
+}
+
+func TestRewritePolicyFromCommandLine(t *testing.T) {
+	// Plain HTML, recognisable only by the command line that started it
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head></head><body><a href="/x">x</a></body></html>`))
+	}))
+	defer backend.Close()
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	newProxy := func(t *testing.T) *Proxy {
+		tcp := fmt.Sprintf("   0: 0100007F:%04X 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 1001 1 0000000000000000 100 0 0 10 0\n", port)
+		root := writeFakeProc(t, tcp, "")
+		addFakeProcess(t, root, "4242", "R\x00-e\x00shiny::runApp()\x00", "1001")
+		p := NewProxy(0, true, false)
+		p.autoRewrite = true
+		p.uid = 1000
+		p.procfs = procFS{root: root}
+		return p
+	}
+
+	t.Run("ports API first", func(t *testing.T) {
+		p := newProxy(t)
+		ports, err := p.listUserPorts()
+		if err != nil || len(ports) != 1 {
+			t.Fatalf("listUserPorts() = %+v, %v", ports, err)
+		}
+		if ports[0].Service != serviceShiny || ports[0].Rewrite {
+			t.Errorf("ports API reported %q, rewrite %v; want shiny, no rewrite", ports[0].Service, ports[0].Rewrite)
+		}
+		if p.shouldRewriteHTML(port) {
+			t.Error("proxy rewrites a port the ports API says it leaves alone")
+		}
+	})
+
+	t.Run("proxy first", func(t *testing.T) {
+		p := newProxy(t)
+		p.shouldRewriteHTML(port)
+		deadline := time.Now().Add(5 * time.Second)
+		for p.shouldRewriteHTML(port) {
+			if time.Now().After(deadline) {
+				t.Fatal("background probe never identified the service from its command line")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := p.identifyService(port, ""); got != serviceShiny {
+			t.Errorf("identifyService() = %q, want %q", got, serviceShiny)
+		}
+	})
+}
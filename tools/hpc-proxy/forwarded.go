@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// normalizeExternalPrefix cleans the --external-prefix value: a leading
+// slash and no trailing one, or "" when the proxy is mounted at the root
+func normalizeExternalPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// routeMount returns the external prefix a route prefix sits under, e.g.
+// /hpc/node01 for /hpc/node01/port/5500
+func routeMount(prefix string) string {
+	i := strings.LastIndex(prefix, "/")
+	if i <= 0 {
+		return ""
+	}
+	j := strings.LastIndex(prefix[:i], "/")
+	if j <= 0 {
+		return ""
+	}
+	return prefix[:j]
+}
+
+// setForwardedHeaders tells the upstream how the browser reached it, so
+// frameworks that configure their base path from proxy headers (Werkzeug
+// ProxyFix, Spring, ASP.NET, Streamlit, Plumber) generate routed URLs.
+// host is the Host the proxy received.
+func setForwardedHeaders(req *http.Request, route routeContext, host string) {
+	proto := requestProto(req)
+	req.Header.Set("X-Forwarded-Host", host)
+	req.Header.Set("X-Forwarded-Proto", proto)
+	if route.preserve {
+		// Nothing was stripped; a prefix would make apps add it twice
+		req.Header.Del("X-Forwarded-Prefix")
+	} else {
+		req.Header.Set("X-Forwarded-Prefix", route.prefix)
+	}
+	req.Header.Set("X-Original-Path", route.originalPath)
+
+	// RFC 7239: append this hop to any Forwarded list from the manager
+	element := "host=" + forwardedValue(host) + ";proto=" + proto
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		element = "for=" + forwardedNode(ip) + ";" + element
+	}
+	if prior := strings.Join(req.Header.Values("Forwarded"), ", "); prior != "" {
+		element = prior + ", " + element
+	}
+	req.Header.Set("Forwarded", element)
+}
+
+// forwardedNode formats an IP address as an RFC 7239 node: IPv6 addresses
+// are bracketed and quoted
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// forwardedValue quotes an RFC 7239 value unless it is a plain token
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !(c == '-' || c == '.' || c == '_' || c == '~' || c == '!' || c == '*' ||
+			c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeExternalPrefix(t *testing.T) {
+	for in, want := range map[string]string{
+		"":             "",
+		"/":            "",
+		"hpc/node01":   "/hpc/node01",
+		"/hpc/node01/": "/hpc/node01",
+	} {
+		if got := normalizeExternalPrefix(in); got != want {
+			t.Errorf("normalizeExternalPrefix(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestIsRoutedPathExternalPrefix(t *testing.T) {
+	tests := []struct {
+		path   string
+		prefix string
+		want   bool
+	}{
+		{"/port/8888/lab", "/port/5500", true},
+		{"/hpc/node01/port/8888/lab", "/hpc/node01/port/5500", true},
+		{"/port/8888/lab", "/hpc/node01/port/5500", false},
+		{"/socket/app/x", "/socket/app", true},
+		{"/lab", "/hpc/node01/port/5500", false},
+	}
+	for _, tt := range tests {
+		if got := isRoutedPath(tt.path, tt.prefix); got != tt.want {
+			t.Errorf("isRoutedPath(%q, %q) = %v, want %v", tt.path, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestProxyForwardedHeaders(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		if r.URL.Path == "/login" {
+			http.Redirect(w, r, "/home", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head></head><body><a href="/x">x</a></body></html>`))
+	}))
+	defer backend.Close()
+	backendPort := strings.TrimPrefix(backend.URL, "http://127.0.0.1:")
+
+	tests := []struct {
+		name           string
+		externalPrefix string
+		forwarded      string
+		wantForwarded  string
+	}{
+		{
+			name:          "mounted at root",
+			wantForwarded: `for=192.0.2.1;host="localhost:9001";proto=https`,
+		},
+		{
+			name:           "mounted under manager path",
+			externalPrefix: "/hpc/node01",
+			forwarded:      "for=198.51.100.7;proto=https",
+			wantForwarded:  `for=198.51.100.7;proto=https, for=192.0.2.1;host="localhost:9001";proto=https`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProxy(0, true, false)
+			p.ownerCheck = false
+			p.externalPrefix = tt.externalPrefix
+			prefix := tt.externalPrefix + "/port/" + backendPort
+
+			req := httptest.NewRequest("GET", "/port/"+backendPort+"/docs/", nil)
+			req.Host = "localhost:9001"
+			req.Header.Set("X-Forwarded-Proto", "https")
+			if tt.forwarded != "" {
+				req.Header.Set("Forwarded", tt.forwarded)
+			}
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			for header, want := range map[string]string{
+				"X-Forwarded-Prefix": prefix,
+				"X-Forwarded-Host":   "localhost:9001",
+				"X-Forwarded-Proto":  "https",
+				"X-Forwarded-For":    "192.0.2.1",
+				"X-Original-Path":    prefix + "/docs/",
+				"Forwarded":          tt.wantForwarded,
+			} {
+				if got.Get(header) != want {
+					t.Errorf("upstream %s = %q, want %q", header, got.Get(header), want)
+				}
+			}
+
+			// URLs handed back to the browser carry the external prefix
+			body := w.Body.String()
+			for _, want := range []string{`<base href="` + prefix + `/docs/">`, `href="` + prefix + `/x"`} {
+				if !strings.Contains(body, want) {
+					t.Errorf("expected %q in response, got: %s", want, body)
+				}
+			}
+			req = httptest.NewRequest("GET", "/port/"+backendPort+"/login", nil)
+			w = httptest.NewRecorder()
+			p.ServeHTTP(w, req)
+			if loc := w.Header().Get("Location"); loc != prefix+"/home" {
+				t.Errorf("Location = %q, want %q", loc, prefix+"/home")
+			}
+		})
+	}
+}
+
+func TestForwardedNode(t *testing.T) {
+	if got := forwardedNode("::1"); got != `"[::1]"` {
+		t.Errorf("forwardedNode(::1) = %s", got)
+	}
+	if got := forwardedValue("host name"); got != `"host name"` {
+		t.Errorf("forwardedValue() = %s", got)
+	}
+}
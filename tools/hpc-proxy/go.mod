@@ -1,3 +1,12 @@
 module github.com/drejom/hpc-proxy
 
-go 1.21
+go 1.22
+
+require (
+	github.com/andybalholm/brotli v1.2.0
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/net v0.35.0
+	golang.org/x/sync v0.11.0
+)
+
+require golang.org/x/text v0.22.0 // indirect
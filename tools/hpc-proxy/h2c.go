@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// h2cHandler serves handler over HTTP/1.1 and over HTTP/2 cleartext, both
+// with prior knowledge (gRPC clients) and via Upgrade: h2c
+func h2cHandler(handler http.Handler) http.Handler {
+	return h2c.NewHandler(handler, &http2.Server{})
+}
+
+// isGRPC reports whether r is a native gRPC call, which only works over
+// HTTP/2 end to end. gRPC-web runs over HTTP/1.1 and is not included.
+func isGRPC(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	return strings.HasPrefix(contentType, "application/grpc") &&
+		!strings.HasPrefix(contentType, "application/grpc-web")
+}
+
+// newH2CTransport returns the transport for upstreams spoken to in HTTP/2
+// with prior knowledge over plain TCP: gRPC servers and anything listed
+// in --h2c-ports. Streams to a port share one connection.
+func newH2CTransport() *http2.Transport {
+	dialer := &net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		// Ping idle connections so a dead upstream fails long streams
+		ReadIdleTimeout: 30 * time.Second,
+	}
+}
+
+// upstreamRoundTripper sends a request over h2c when its route asks for
+// it and over HTTP/1.1 otherwise
+type upstreamRoundTripper struct {
+	http1 http.RoundTripper
+	h2c   http.RoundTripper
+}
+
+func (t *upstreamRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if routeFrom(req.Context()).h2c {
+		return t.h2c.RoundTrip(req)
+	}
+	return t.http1.RoundTrip(req)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestIsGRPC(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"application/grpc", true},
+		{"application/grpc+proto", true},
+		{"application/grpc-web+proto", false},
+		{"application/grpc-web-text", false},
+		{"application/json", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/port/50051/svc/Method", nil)
+		req.Header.Set("Content-Type", tt.contentType)
+		if got := isGRPC(req); got != tt.want {
+			t.Errorf("isGRPC(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+// grpcFrame encodes msg as a gRPC length-prefixed message
+func grpcFrame(msg string) []byte {
+	frame := make([]byte, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(msg)))
+	copy(frame[5:], msg)
+	return frame
+}
+
+// readGRPCFrame reads one gRPC length-prefixed message
+func readGRPCFrame(r io.Reader) (string, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", err
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return "", err
+	}
+	return string(msg), nil
+}
+
+// grpcEchoBackend is an h2c-only bidirectional streaming echo service
+// answering like a gRPC server: each message is echoed as it arrives and
+// the status is sent in trailers
+func grpcEchoBackend(t *testing.T) string {
+	t.Helper()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http.Error(w, "gRPC requires HTTP/2", http.StatusHTTPVersionNotSupported)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			msg, err := readGRPCFrame(r.Body)
+			if err != nil {
+				break
+			}
+			w.Write(grpcFrame(r.URL.Path + ": " + msg))
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "done")
+	})
+	srv := httptest.NewUnstartedServer(h2c.NewHandler(handler, &http2.Server{}))
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://127.0.0.1:")
+}
+
+// h2cClient speaks HTTP/2 with prior knowledge, as gRPC clients do
+func h2cClient() *http.Client {
+	return &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+}
+
+func TestProxyGRPCStreaming(t *testing.T) {
+	backendPort := grpcEchoBackend(t)
+
+	p := NewProxy(0, true, false)
+	p.ownerCheck = false
+	port, err := p.Start()
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer p.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	body, requests := io.Pipe()
+	req, _ := http.NewRequestWithContext(ctx, "POST",
+		fmt.Sprintf("http://127.0.0.1:%d/port/%s/echo.Echo/Chat", port, backendPort), body)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := h2cClient().Do(req)
+	if err != nil {
+		t.Fatalf("gRPC call through proxy: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		b, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected HTTP/2 200, got %s %d: %s", resp.Proto, resp.StatusCode, b)
+	}
+
+	// Each reply must arrive before the next message is sent
+	for _, msg := range []string{"first", "second", "third"} {
+		if _, err := requests.Write(grpcFrame(msg)); err != nil {
+			t.Fatalf("send %q: %v", msg, err)
+		}
+		got, err := readGRPCFrame(resp.Body)
+		if err != nil {
+			t.Fatalf("receive reply to %q: %v", msg, err)
+		}
+		if want := "/echo.Echo/Chat: " + msg; got != want {
+			t.Errorf("reply = %q, want %q", got, want)
+		}
+	}
+	requests.Close()
+
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatalf("read end of stream: %v", err)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("Grpc-Status trailer = %q, want 0 (trailers %v)", got, resp.Trailer)
+	}
+	if got := resp.Trailer.Get("Grpc-Message"); got != "done" {
+		t.Errorf("Grpc-Message trailer = %q, want done", got)
+	}
+}
+
+func TestProxyH2CPorts(t *testing.T) {
+	backend := httptest.NewUnstartedServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	}), &http2.Server{}))
+	backend.Start()
+	defer backend.Close()
+	backendPort := strings.TrimPrefix(backend.URL, "http://127.0.0.1:")
+
+	p := NewProxy(0, false, false)
+	p.ownerCheck = false
+
+	req := httptest.NewRequest("GET", "/port/"+backendPort+"/", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Body.String() != "HTTP/1.1" {
+		t.Errorf("expected HTTP/1.1 upstream by default, got %q", w.Body.String())
+	}
+
+	p.h2cPorts, _ = parsePortSet(backendPort)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Body.String() != "HTTP/2.0" {
+		t.Errorf("expected HTTP/2.0 upstream with --h2c-ports, got %q", w.Body.String())
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// tlsVerifyMode is how certificates of HTTPS upstreams are checked.
+// Services on a node's loopback use self-signed certificates for names
+// like localhost, so chain verification would always fail.
+type tlsVerifyMode string
+
+const (
+	tlsVerifyPin  tlsVerifyMode = "pin"  // trust the first certificate per port, refuse changes
+	tlsVerifySkip tlsVerifyMode = "skip" // accept any certificate
+)
+
+// parseTLSVerifyMode parses the --upstream-tls flag
+func parseTLSVerifyMode(s string) (tlsVerifyMode, error) {
+	switch mode := tlsVerifyMode(s); mode {
+	case tlsVerifyPin, tlsVerifySkip:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid mode %q (want pin or skip)", s)
+}
+
+// errCertChanged reports an upstream presenting a certificate other than
+// the one pinned for its port
+var errCertChanged = errors.New("upstream certificate changed")
+
+// certPins remembers the SHA-256 fingerprint of the leaf certificate
+// first seen on each port
+type certPins struct {
+	mu   sync.Mutex
+	pins map[int][sha256.Size]byte
+}
+
+func newCertPins() *certPins {
+	return &certPins{pins: make(map[int][sha256.Size]byte)}
+}
+
+// check pins cert for port on first use and fails if a later one differs
+func (c *certPins) check(port int, cert *x509.Certificate) error {
+	sum := sha256.Sum256(cert.Raw)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pinned, ok := c.pins[port]
+	if !ok {
+		c.pins[port] = sum
+		log.Printf("Pinned certificate for port %d: %q, SHA-256 %x", port, cert.Subject.String(), sum)
+		return nil
+	}
+	if pinned != sum {
+		return fmt.Errorf("%w on port %d: SHA-256 %x, pinned %x", errCertChanged, port, sum, pinned)
+	}
+	return nil
+}
+
+// retain drops pins for ports no longer listening, so a service restarted
+// with a fresh self-signed certificate is trusted again
+func (c *certPins) retain(listening map[int]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for port := range c.pins {
+		if !listening[port] {
+			delete(c.pins, port)
+		}
+	}
+}
+
+// newTLSTransport returns a transport for an HTTPS upstream on port. It
+// is tuned like the shared transport but kept per port, since the pinned
+// certificate depends on it.
+func (p *Proxy) newTLSTransport(port int) *http.Transport {
+	transport := newUpstreamTransport()
+	transport.TLSClientConfig = &tls.Config{
+		// Self-signed; checked against the pin below instead
+		InsecureSkipVerify: true,
+	}
+	if p.tlsVerify == tlsVerifyPin {
+		transport.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("upstream sent no certificate")
+			}
+			return p.certPins.check(port, cs.PeerCertificates[0])
+		}
+	}
+	return transport
+}
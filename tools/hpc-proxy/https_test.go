@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseTLSRoute(t *testing.T) {
+	port, remaining, ok := parseTLSRoute("/sport/8787/auth-sign-in")
+	if !ok || port != 8787 || remaining != "/auth-sign-in" {
+		t.Errorf("parseTLSRoute() = %d, %q, %v", port, remaining, ok)
+	}
+	if _, remaining, _ := parseTLSRoute("/sport/8787"); remaining != "/" {
+		t.Errorf("parseTLSRoute() without path = %q, want /", remaining)
+	}
+	if _, _, ok := parseTLSRoute("/port/8787/"); ok {
+		t.Error("parseTLSRoute() matched a plain /port route")
+	}
+}
+
+// tlsBackend starts a self-signed HTTPS service serving a page with a
+// root-relative link, like RStudio Server or Jupyter with --certfile
+func tlsBackend(t *testing.T) (*httptest.Server, int) {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.Redirect(w, r, "/home", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><head></head><body><a href="/docs">%s</a></body></html>`, r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+	port, _ := strconv.Atoi(strings.TrimPrefix(srv.URL, "https://127.0.0.1:"))
+	return srv, port
+}
+
+func TestProxyTLSUpstream(t *testing.T) {
+	srv, port := tlsBackend(t)
+
+	p := NewProxy(0, true, false)
+	p.ownerCheck = false
+	p.upstreams.hosts = func() []string { return []string{"127.0.0.1"} }
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/sport/%d/lab", port), nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if want := fmt.Sprintf(`href="/sport/%d/docs"`, port); !strings.Contains(w.Body.String(), want) {
+		t.Errorf("expected %s in rewritten body, got: %s", want, w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", fmt.Sprintf("/sport/%d/login", port), nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if loc := w.Header().Get("Location"); loc != fmt.Sprintf("/sport/%d/home", port) {
+		t.Errorf("expected redirect under /sport, got %q", loc)
+	}
+
+	// The first connection pinned the service's certificate
+	want := sha256.Sum256(srv.Certificate().Raw)
+	if pinned, ok := p.certPins.pins[port]; !ok || pinned != want {
+		t.Errorf("expected certificate of port %d to be pinned", port)
+	}
+}
+
+func TestProxyTLSCertificateChanged(t *testing.T) {
+	_, port := tlsBackend(t)
+
+	p := NewProxy(0, false, false)
+	p.ownerCheck = false
+	p.upstreams.hosts = func() []string { return []string{"127.0.0.1"} }
+	p.certPins.pins[port] = sha256.Sum256([]byte("an earlier certificate"))
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/sport/%d/", port), nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expected status 502, got %d: %s", w.Code, w.Body.String())
+	}
+	var f upstreamFailure
+	if err := json.Unmarshal(w.Body.Bytes(), &f); err != nil || f.Kind != failCertChanged {
+		t.Errorf("expected %s error, got %s", failCertChanged, w.Body.String())
+	}
+
+	// Without pinning any certificate is accepted
+	p = NewProxy(0, false, false)
+	p.ownerCheck = false
+	p.tlsVerify = tlsVerifySkip
+	p.certPins.pins[port] = sha256.Sum256([]byte("an earlier certificate"))
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200 with --upstream-tls=skip, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestProxyTLSRouteToPlainService(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	port := strings.TrimPrefix(backend.URL, "http://127.0.0.1:")
+
+	p := NewProxy(0, false, false)
+	p.ownerCheck = false
+	p.upstreams.hosts = func() []string { return []string{"127.0.0.1"} }
+
+	req := httptest.NewRequest("GET", "/sport/"+port+"/", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	var f upstreamFailure
+	if err := json.Unmarshal(w.Body.Bytes(), &f); err != nil || f.Kind != failNotTLS {
+		t.Fatalf("expected %s error, got %d: %s", failNotTLS, w.Code, w.Body.String())
+	}
+	if !strings.Contains(f.Fix[0].Text, "/port/"+port+"/") {
+		t.Errorf("expected the plain route to be suggested, got %v", f.Fix)
+	}
+}
+
+func TestCertPinsRetain(t *testing.T) {
+	pins := newCertPins()
+	pins.pins[8787] = sha256.Sum256([]byte("a"))
+	pins.pins[8888] = sha256.Sum256([]byte("b"))
+
+	pins.retain(map[int]bool{8787: true})
+	if _, ok := pins.pins[8787]; !ok {
+		t.Error("pin for listening port was dropped")
+	}
+	if _, ok := pins.pins[8888]; ok {
+		t.Error("pin for closed port was kept")
+	}
+}
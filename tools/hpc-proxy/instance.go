@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errInstanceRunning is returned when another proxy holds the instance lock
+var errInstanceRunning = errors.New("another hpc-proxy instance is running")
+
+// instanceLock is an exclusive flock held for the lifetime of the proxy.
+// The kernel drops it automatically if the process dies, so a lock that
+// can be acquired means any previous port file is stale.
+type instanceLock struct {
+	path string
+	file *os.File
+}
+
+// instanceOwner is the PID and hostname recorded inside the lock file
+type instanceOwner struct {
+	PID      int
+	Hostname string
+}
+
+// lockPathFor returns the lock file used alongside a port file
+func lockPathFor(portFile string) string {
+	return portFile + ".lock"
+}
+
+// acquireInstanceLock takes a non-blocking exclusive lock on path and
+// records this process as the owner
+func acquireInstanceLock(path string) (*instanceLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("create directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open lock file: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errInstanceRunning
+		}
+		return nil, fmt.Errorf("flock: %w", err)
+	}
+
+	hostname, _ := os.Hostname()
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(fmt.Sprintf("%d\n%s\n", os.Getpid(), hostname)), 0)
+	}
+	return &instanceLock{path: path, file: f}, nil
+}
+
+// waitForInstanceLock retries acquireInstanceLock until timeout, used while
+// a replaced instance shuts down
+func waitForInstanceLock(path string, timeout time.Duration) (*instanceLock, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		lock, err := acquireInstanceLock(path)
+		if !errors.Is(err, errInstanceRunning) || time.Now().After(deadline) {
+			return lock, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Release drops the lock. The lock file itself is left in place so that
+// concurrent starters always lock the same inode.
+func (l *instanceLock) Release() {
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+}
+
+// readInstanceOwner parses the PID and hostname from a lock file
+func readInstanceOwner(path string) (instanceOwner, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return instanceOwner{}, err
+	}
+	lines := strings.SplitN(string(data), "\n", 3)
+	pid, err := strconv.Atoi(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return instanceOwner{}, fmt.Errorf("bad pid in lock file: %w", err)
+	}
+	owner := instanceOwner{PID: pid}
+	if len(lines) > 1 {
+		owner.Hostname = strings.TrimSpace(lines[1])
+	}
+	return owner, nil
+}
+
+// readPortFile returns the port from the first line of a port file
+func readPortFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return 0, fmt.Errorf("empty port file")
+	}
+	return strconv.Atoi(strings.TrimSpace(scanner.Text()))
+}
+
+// processAlive reports whether pid exists on this host
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// isProxyProcess reports whether pid runs hpc-proxy, judged by its command
+// line, so a PID reused by another program is never signalled
+func isProxyProcess(pid int) bool {
+	argv0, _, _ := strings.Cut(procFS{root: "/proc"}.cmdline(pid), " ")
+	return strings.HasPrefix(filepath.Base(argv0), "hpc-proxy")
+}
+
+// isOwnInstance reports whether a health response comes from a proxy run
+// by this user on this node. The port file sits in a home directory
+// shared across nodes, so its port may now be answered by anyone.
+func isOwnInstance(info healthInfo) bool {
+	hostname, _ := os.Hostname()
+	return info.UID == os.Getuid() && info.Hostname == hostname
+}
+
+// probeHealth queries the health endpoint of a proxy on localhost:port
+func probeHealth(port int, timeout time.Duration) (healthInfo, bool) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d%s", port, healthPath))
+	if err != nil {
+		return healthInfo{}, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return healthInfo{}, false
+	}
+	var info healthInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil || info.Status != "ok" {
+		return healthInfo{}, false
+	}
+	return info, true
+}
+
+// claimInstance makes this process the single proxy instance for portFile.
+//
+// If the lock is free, any leftover port file is checked: a port that still
+// answers the health endpoint as this user's proxy on this node belongs to
+// a live (unlocked) instance, otherwise the file is stale and removed. If
+// the lock is held, the owner is either reported as an error or, with
+// replace set, sent SIGTERM so this process can take over once it has
+// cleaned up. Only PIDs running hpc-proxy on this node are ever signalled.
+func claimInstance(portFile string, replace bool) (*instanceLock, error) {
+	lockPath := lockPathFor(portFile)
+
+	lock, err := acquireInstanceLock(lockPath)
+	if err == nil {
+		oldPort, perr := readPortFile(portFile)
+		if perr != nil {
+			return lock, nil
+		}
+		health, alive := probeHealth(oldPort, time.Second)
+		if alive && !isOwnInstance(health) {
+			log.Printf("Port %d is answered by pid %d of uid %d on %q, not an instance of ours", oldPort, health.PID, health.UID, health.Hostname)
+			alive = false
+		}
+		if !alive {
+			log.Printf("Removing stale port file %s (port %d not responding)", portFile, oldPort)
+			os.Remove(portFile)
+			return lock, nil
+		}
+		if !replace {
+			lock.Release()
+			return nil, fmt.Errorf("%w: pid %d answering on port %d; stop it or use --replace", errInstanceRunning, health.PID, oldPort)
+		}
+		if !processAlive(health.PID) || !isProxyProcess(health.PID) {
+			lock.Release()
+			return nil, fmt.Errorf("%w: pid %d answering on port %d is not an hpc-proxy process; cannot replace it", errInstanceRunning, health.PID, oldPort)
+		}
+		log.Printf("Replacing unlocked instance pid %d on port %d", health.PID, oldPort)
+		syscall.Kill(health.PID, syscall.SIGTERM)
+		return lock, nil
+	}
+	if !errors.Is(err, errInstanceRunning) {
+		return nil, err
+	}
+
+	owner, oerr := readInstanceOwner(lockPath)
+	if oerr != nil {
+		return nil, fmt.Errorf("%w (owner unknown: %v)", errInstanceRunning, oerr)
+	}
+	desc := fmt.Sprintf("pid %d on %s", owner.PID, owner.Hostname)
+	if oldPort, perr := readPortFile(portFile); perr == nil {
+		if _, alive := probeHealth(oldPort, time.Second); alive {
+			desc += fmt.Sprintf(", port %d", oldPort)
+		} else {
+			desc += fmt.Sprintf(", port %d not responding", oldPort)
+		}
+	}
+	if !replace {
+		return nil, fmt.Errorf("%w (%s); stop it or use --replace", errInstanceRunning, desc)
+	}
+
+	hostname, _ := os.Hostname()
+	if owner.Hostname != hostname || !processAlive(owner.PID) || !isProxyProcess(owner.PID) {
+		return nil, fmt.Errorf("%w (%s); cannot replace it from %s", errInstanceRunning, desc, hostname)
+	}
+	log.Printf("Replacing running instance (%s)", desc)
+	if err := syscall.Kill(owner.PID, syscall.SIGTERM); err != nil {
+		return nil, fmt.Errorf("signal pid %d: %w", owner.PID, err)
+	}
+	return waitForInstanceLock(lockPath, 10*time.Second)
+}
+
+// removeIfOwned deletes path only if it still holds the content this
+// process wrote, so a replacement instance's files are never removed
+func removeIfOwned(path string, content []byte) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(data, content) {
+		log.Printf("Leaving %s in place (rewritten by another instance)", path)
+		return
+	}
+	os.Remove(path)
+}
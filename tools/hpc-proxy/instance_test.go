@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquireInstanceLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "port.lock")
+
+	lock, err := acquireInstanceLock(path)
+	if err != nil {
+		t.Fatalf("acquireInstanceLock() error = %v", err)
+	}
+
+	owner, err := readInstanceOwner(path)
+	if err != nil {
+		t.Fatalf("readInstanceOwner() error = %v", err)
+	}
+	if owner.PID != os.Getpid() {
+		t.Errorf("owner pid = %d, want %d", owner.PID, os.Getpid())
+	}
+
+	// flock conflicts between open file descriptions, even in one process
+	if _, err := acquireInstanceLock(path); !errors.Is(err, errInstanceRunning) {
+		t.Errorf("second acquire error = %v, want errInstanceRunning", err)
+	}
+
+	lock.Release()
+	lock2, err := acquireInstanceLock(path)
+	if err != nil {
+		t.Fatalf("acquire after release error = %v", err)
+	}
+	lock2.Release()
+}
+
+func TestClaimInstanceStalePortFile(t *testing.T) {
+	portFile := filepath.Join(t.TempDir(), "port")
+
+	// Port 1 is never a live hpc-proxy
+	if err := os.WriteFile(portFile, []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := claimInstance(portFile, false)
+	if err != nil {
+		t.Fatalf("claimInstance() error = %v", err)
+	}
+	defer lock.Release()
+
+	if _, err := os.Stat(portFile); !os.IsNotExist(err) {
+		t.Errorf("expected stale port file to be removed, stat err = %v", err)
+	}
+}
+
+func TestClaimInstanceLiveUnlocked(t *testing.T) {
+	portFile := filepath.Join(t.TempDir(), "port")
+
+	p := NewProxy(0, false, false)
+	port, err := p.Start()
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer p.Shutdown()
+
+	if err := writePortFile(portFile, port, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := claimInstance(portFile, false); !errors.Is(err, errInstanceRunning) {
+		t.Errorf("claimInstance() error = %v, want errInstanceRunning", err)
+	}
+	// The lock must not be left held after refusing
+	lock, err := acquireInstanceLock(lockPathFor(portFile))
+	if err != nil {
+		t.Fatalf("lock still held after refusal: %v", err)
+	}
+	lock.Release()
+}
+
+func TestClaimInstanceLocked(t *testing.T) {
+	portFile := filepath.Join(t.TempDir(), "port")
+
+	held, err := acquireInstanceLock(lockPathFor(portFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Release()
+
+	if _, err := claimInstance(portFile, false); !errors.Is(err, errInstanceRunning) {
+		t.Errorf("claimInstance() error = %v, want errInstanceRunning", err)
+	}
+}
+
+func TestProbeHealth(t *testing.T) {
+	p := NewProxy(0, false, false)
+	p.token = "secret" // health must stay reachable without the token
+	port, err := p.Start()
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer p.Shutdown()
+
+	info, ok := probeHealth(port, time.Second)
+	if !ok {
+		t.Fatal("expected healthy proxy")
+	}
+	if info.PID != os.Getpid() || info.Port != port {
+		t.Errorf("unexpected health info: %+v", info)
+	}
+	if !isOwnInstance(info) {
+		t.Errorf("expected own instance, got uid %d on %q", info.UID, info.Hostname)
+	}
+}
+
+func TestClaimInstanceForeignResponder(t *testing.T) {
+	portFile := filepath.Join(t.TempDir(), "port")
+
+	// Another user's proxy, or one on another node, now answers the port
+	hostname, _ := os.Hostname()
+	foreign := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, healthInfo{Status: "ok", PID: 1, UID: os.Getuid() + 1, Hostname: hostname})
+	}))
+	defer foreign.Close()
+	port, _ := strconv.Atoi(strings.TrimPrefix(foreign.URL, "http://127.0.0.1:"))
+	if err := writePortFile(portFile, port, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := claimInstance(portFile, true)
+	if err != nil {
+		t.Fatalf("claimInstance() error = %v", err)
+	}
+	defer lock.Release()
+
+	if _, err := os.Stat(portFile); !os.IsNotExist(err) {
+		t.Errorf("expected port file answered by a foreign proxy to be removed, stat err = %v", err)
+	}
+}
+
+func TestIsProxyProcess(t *testing.T) {
+	// The test binary is hpc-proxy.test
+	if !isProxyProcess(os.Getpid()) {
+		t.Error("expected the test process to count as hpc-proxy")
+	}
+	if isProxyProcess(-1) {
+		t.Error("expected an invalid pid not to count as hpc-proxy")
+	}
+}
+
+func TestRemoveIfOwned(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "port")
+
+	mine := portFileContent(9001, "")
+	os.WriteFile(path, []byte(strconv.Itoa(9002)+"\n"), 0644)
+	removeIfOwned(path, mine)
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("file rewritten by another instance was removed")
+	}
+
+	os.WriteFile(path, mine, 0644)
+	removeIfOwned(path, mine)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected owned file to be removed")
+	}
+}
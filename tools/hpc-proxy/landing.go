@@ -0,0 +1,65 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+//go:embed templates/index.html
+var indexHTML string
+
+// indexTemplate renders the landing page; it has no external assets so it
+// works on compute nodes without internet access
+var indexTemplate = template.Must(template.New("index").Parse(indexHTML))
+
+// indexData is the view model for templates/index.html
+type indexData struct {
+	Root      string // landing page URL, for the manual entry form
+	Hostname  string
+	ProxyPort int
+	Version   string
+	Ports     []listeningPort
+	Sockets   []listeningSocket
+	Error     string
+}
+
+// serveIndex renders the landing page listing the user's ports. A
+// submitted ?port=N from the manual entry form redirects to /port/N/.
+func (p *Proxy) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if raw := r.URL.Query().Get("port"); raw != "" {
+		target, err := strconv.Atoi(raw)
+		if err != nil || target < 1 || target > 65535 {
+			http.Error(w, "Invalid port number", http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("%s/port/%d/", p.externalPrefix, target), http.StatusFound)
+		return
+	}
+
+	hostname, _ := os.Hostname()
+	data := indexData{
+		Root:      p.externalPrefix + "/",
+		Hostname:  hostname,
+		ProxyPort: p.port,
+		Version:   version,
+	}
+	ports, err := p.listUserPorts()
+	if err != nil {
+		data.Error = err.Error()
+	}
+	data.Ports = ports
+	if sockets, err := p.listUserSockets(); err == nil {
+		data.Sockets = sockets
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := indexTemplate.Execute(w, data); err != nil {
+		log.Printf("Failed to render index: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeIndex(t *testing.T) {
+	tcp := "   0: 0100007F:0EFE 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 1001 1 0000000000000000 100 0 0 10 0\n"
+	root := writeFakeProc(t, tcp, "")
+	addFakeProcess(t, root, "4242", "R\x00-e\x00shiny::runApp(port=3838)\x00", "1001")
+
+	p := NewProxy(9001, false, false)
+	p.uid = 1000
+	p.procfs = procFS{root: root}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("Content-Type = %q", w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	for _, want := range []string{`href="/port/3838/"`, "Shiny", "shiny::runApp(port=3838)", `name="port"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in landing page, got: %s", want, body)
+		}
+	}
+	// Self-contained: no external scripts or stylesheets
+	if strings.Contains(body, "<script") || strings.Contains(body, "<link") {
+		t.Errorf("landing page must not reference external assets")
+	}
+}
+
+func TestServeIndexEmpty(t *testing.T) {
+	p := NewProxy(9001, false, false)
+	p.uid = 1000
+	p.procfs = procFS{root: writeFakeProc(t, "", "")}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if !strings.Contains(w.Body.String(), "No listening ports found") {
+		t.Errorf("expected empty-state message, got: %s", w.Body.String())
+	}
+}
+
+func TestServeIndexManualPort(t *testing.T) {
+	p := NewProxy(9001, false, false)
+
+	tests := []struct {
+		query        string
+		wantStatus   int
+		wantLocation string
+	}{
+		{"?port=5500", http.StatusFound, "/port/5500/"},
+		{"?port=0", http.StatusBadRequest, ""},
+		{"?port=abc", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/"+tt.query, nil)
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// linkURLPattern matches the target of each link in a Link header
+var linkURLPattern = regexp.MustCompile(`<([^>]*)>`)
+
+// rewriteLocation rewrites the URL-bearing response headers (Location on
+// redirects and 201 Created, Content-Location, Refresh and Link) so they
+// point back through the route. Root-relative URLs are prefixed, and
+// absolute URLs naming the upstream itself (http://127.0.0.1:5500/login,
+// http://localhost:8888/lab) become the equivalent routed path, since
+// those hosts mean nothing on the user's machine.
+func (p *Proxy) rewriteLocation(resp *http.Response, route routeContext) {
+	for _, name := range []string{"Location", "Content-Location"} {
+		value := resp.Header.Get(name)
+		if value == "" {
+			continue
+		}
+		if newValue, ok := rewriteHeaderURL(value, route); ok {
+			resp.Header.Set(name, newValue)
+			p.logHeaderRewrite(name, value, newValue)
+		}
+	}
+
+	if value := resp.Header.Get("Refresh"); value != "" {
+		if m := refreshPattern.FindStringSubmatch(value); m != nil {
+			target := strings.TrimRight(m[2], `"'`)
+			if newTarget, ok := rewriteHeaderURL(target, route); ok {
+				newValue := m[1] + newTarget + m[2][len(target):]
+				resp.Header.Set("Refresh", newValue)
+				p.logHeaderRewrite("Refresh", value, newValue)
+			}
+		}
+	}
+
+	if values := resp.Header.Values("Link"); len(values) > 0 {
+		changed := false
+		rewritten := make([]string, len(values))
+		for i, value := range values {
+			rewritten[i] = linkURLPattern.ReplaceAllStringFunc(value, func(match string) string {
+				target, ok := rewriteHeaderURL(match[1:len(match)-1], route)
+				if !ok {
+					return match
+				}
+				changed = true
+				return "<" + target + ">"
+			})
+		}
+		if changed {
+			resp.Header["Link"] = rewritten
+			p.logHeaderRewrite("Link", strings.Join(values, ", "), strings.Join(rewritten, ", "))
+		}
+	}
+}
+
+// logHeaderRewrite logs a rewritten header in verbose mode
+func (p *Proxy) logHeaderRewrite(name, from, to string) {
+	if p.verbose {
+		log.Printf("Rewrote %s header: %s -> %s", name, from, to)
+	}
+}
+
+// rewriteHeaderURL routes a URL from a response header, reporting whether
+// it changed. Other hosts and relative URLs are left alone.
+func rewriteHeaderURL(value string, route routeContext) (string, bool) {
+	if path, ok := upstreamURLPath(value, route.port); ok {
+		value = path
+	}
+	return prefixURL(value, route.prefix)
+}
+
+// upstreamURLPath returns the path, query and fragment of an absolute URL
+// addressing the upstream directly: a loopback address or one of this
+// node's names and addresses, on the target port. For socket upstreams
+// (port 0) only portless URLs on this node match.
+func upstreamURLPath(value string, port int) (string, bool) {
+	if !strings.Contains(value, "://") {
+		return "", false
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return "", false
+	}
+	if scheme := strings.ToLower(u.Scheme); scheme != "http" && scheme != "https" {
+		return "", false
+	}
+	if !isNodeHost(u.Hostname()) {
+		return "", false
+	}
+
+	urlPort := u.Port()
+	if port == 0 {
+		if urlPort != "" {
+			return "", false
+		}
+	} else {
+		if urlPort == "" {
+			urlPort = "80"
+			if strings.EqualFold(u.Scheme, "https") {
+				urlPort = "443"
+			}
+		}
+		if urlPort != strconv.Itoa(port) {
+			return "", false
+		}
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" || u.ForceQuery {
+		path += "?" + u.RawQuery
+	}
+	if u.Fragment != "" {
+		path += "#" + u.EscapedFragment()
+	}
+	return path, true
+}
+
+// isNodeHost reports whether host names this node: localhost, a loopback
+// or unspecified address, the hostname, or an interface address
+func isNodeHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsLoopback() || ip.IsUnspecified() {
+			return true
+		}
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return false
+		}
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return false
+	}
+	hostname = strings.ToLower(hostname)
+	short, _, _ := strings.Cut(hostname, ".")
+	return host == hostname || host == short || strings.HasPrefix(host, short+".")
+}
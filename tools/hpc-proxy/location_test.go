@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUpstreamURLPath(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("os.Hostname() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		value    string
+		port     int
+		wantPath string
+		wantOk   bool
+	}{
+		{"ipv4 loopback", "http://127.0.0.1:5500/login?next=/x", 5500, "/login?next=/x", true},
+		{"localhost", "http://localhost:8888/lab#tree", 8888, "/lab#tree", true},
+		{"ipv6 loopback", "http://[::1]:5173/", 5173, "/", true},
+		{"unspecified", "http://0.0.0.0:3838", 3838, "/", true},
+		{"node hostname", "http://" + hostname + ":5500/a", 5500, "/a", true},
+		{"https default port", "https://localhost/a", 443, "/a", true},
+		{"other port", "http://127.0.0.1:9999/login", 5500, "", false},
+		{"other host", "http://example.com:5500/login", 5500, "", false},
+		{"relative", "/login", 5500, "", false},
+		{"socket portless", "http://localhost/lab", 0, "/lab", true},
+		{"socket with port", "http://localhost:8888/lab", 0, "", false},
+		{"not http", "ftp://localhost:5500/x", 5500, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, ok := upstreamURLPath(tt.value, tt.port)
+			if ok != tt.wantOk || path != tt.wantPath {
+				t.Errorf("upstreamURLPath(%q, %d) = %q, %v, want %q, %v", tt.value, tt.port, path, ok, tt.wantPath, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestRewriteResponseAbsoluteLocation(t *testing.T) {
+	p := NewProxy(0, true, false)
+
+	tests := []struct {
+		name         string
+		location     string
+		wantLocation string
+	}{
+		{"loopback", "http://127.0.0.1:5500/login", "/port/5500/login"},
+		{"localhost with query", "http://localhost:5500/lab?token=x", "/port/5500/lab?token=x"},
+		{"other port kept", "http://localhost:8888/lab", "http://localhost:8888/lab"},
+		{"other host kept", "https://accounts.example.com/auth", "https://accounts.example.com/auth"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: http.StatusFound,
+				Header:     http.Header{"Location": []string{tt.location}},
+				Body:       io.NopCloser(strings.NewReader("")),
+			}
+			if err := p.rewriteResponse(resp, 5500, "/port/5500/"); err != nil {
+				t.Fatalf("rewriteResponse() error = %v", err)
+			}
+			if got := resp.Header.Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+}
+
+func TestRewriteResponseURLHeaders(t *testing.T) {
+	p := NewProxy(0, true, false)
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Content-Location": []string{"http://127.0.0.1:5500/report.html"},
+			"Refresh":          []string{"3; url='http://localhost:5500/done'"},
+			"Link": []string{
+				`</style.css>; rel=preload; as=style, <https://cdn.example.com/x.js>; rel=preload`,
+				`<http://localhost:5500/next>; rel="next"`,
+			},
+		},
+		Body: io.NopCloser(strings.NewReader("")),
+	}
+	if err := p.rewriteResponse(resp, 5500, "/port/5500/"); err != nil {
+		t.Fatalf("rewriteResponse() error = %v", err)
+	}
+
+	if got, want := resp.Header.Get("Content-Location"), "/port/5500/report.html"; got != want {
+		t.Errorf("Content-Location = %q, want %q", got, want)
+	}
+	if got, want := resp.Header.Get("Refresh"), "3; url='/port/5500/done'"; got != want {
+		t.Errorf("Refresh = %q, want %q", got, want)
+	}
+	wantLinks := []string{
+		`</port/5500/style.css>; rel=preload; as=style, <https://cdn.example.com/x.js>; rel=preload`,
+		`</port/5500/next>; rel="next"`,
+	}
+	if got := resp.Header.Values("Link"); !reflect.DeepEqual(got, wantLinks) {
+		t.Errorf("Link = %q, want %q", got, wantLinks)
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 )
 
 var (
@@ -24,17 +25,57 @@ var (
 	buildTime = "unknown"
 
 	// CLI flags
-	port        int
-	baseRewrite bool
-	portFile    string
-	verbose     bool
-	showVersion bool
+	port          int
+	baseRewrite   bool
+	portFile      string
+	socketDir     string
+	discoveryFile string
+	verbose       bool
+	showVersion   bool
+
+	skipOwnerCheck bool
+	tokenAuth      bool
+	replace        bool
+	autoRewrite    bool
+	shimPorts      string
+	cookieNS       bool
+
+	hostRewritePorts   string
+	originRewritePorts string
+	originDropPorts    string
+
+	startupWait  time.Duration
+	startupGrace time.Duration
+	upstreamTLS  string
+	h2cPorts     string
+
+	externalPrefix  string
+	compressTypes   string
+	compressMinSize int64
 )
 
 func init() {
 	flag.IntVar(&port, "port", 0, "Port to listen on (required, or use 0 for auto-assign)")
 	flag.BoolVar(&baseRewrite, "base-rewrite", false, "Inject <base> tag into HTML responses for relative URL handling")
+	flag.BoolVar(&autoRewrite, "auto-rewrite", false, "Pick HTML rewriting per detected service (Shiny, Jupyter, Vite, ...); --base-rewrite applies to unrecognised services")
+	flag.StringVar(&shimPorts, "shim-ports", "", "Comma-separated ports (or \"all\") whose HTML gets a script prefixing URLs built in JavaScript (fetch, XHR, WebSocket, EventSource, history)")
+	flag.BoolVar(&cookieNS, "cookie-namespace", false, "Prefix cookie names set by upstreams with their route (e.g. hpc.port-5500.) so apps cannot read each other's cookies")
+	flag.StringVar(&hostRewritePorts, "host-rewrite-ports", "", "Comma-separated ports (or \"all\") that receive their own address as Host, for dev servers with host checks (Vite, webpack-dev-server)")
+	flag.StringVar(&originRewritePorts, "origin-rewrite-ports", "", "Comma-separated ports (or \"all\") whose Origin and Referer headers are rewritten to the upstream address (Jupyter, Shiny WebSocket origin checks)")
+	flag.StringVar(&originDropPorts, "origin-drop-ports", "", "Comma-separated ports (or \"all\") whose Origin and Referer headers are removed")
+	flag.DurationVar(&startupWait, "startup-wait", defaultStartupWait, "How long the page shown for a port that is not listening yet keeps waiting for it (0 returns 502 immediately)")
+	flag.DurationVar(&startupGrace, "startup-grace", 0, "Hold non-browser requests to a port that is not listening yet for up to this long before failing")
+	flag.StringVar(&h2cPorts, "h2c-ports", "", "Comma-separated ports (or \"all\") spoken to in HTTP/2 cleartext; gRPC calls always are")
+	flag.StringVar(&upstreamTLS, "upstream-tls", string(tlsVerifyPin), "How certificates of /sport/:port HTTPS upstreams are checked: \"pin\" trusts the first certificate seen per port and refuses changes, \"skip\" accepts any")
+	flag.StringVar(&externalPrefix, "external-prefix", "", "Path the manager mounts this proxy under (e.g. /hpc/node01); used in rewritten URLs and X-Forwarded-Prefix")
+	flag.StringVar(&compressTypes, "compress-types", defaultCompressTypes, "Comma-separated media types (type/* allowed) compressed on the way to the client when the upstream sent them uncompressed; empty disables")
+	flag.Int64Var(&compressMinSize, "compress-min-size", defaultCompressMinSize, "Smallest response, in bytes, that is compressed for the client")
 	flag.StringVar(&portFile, "port-file", "", "File to write assigned port (default: ~/.hpc-proxy/port)")
+	flag.StringVar(&socketDir, "socket-dir", "", "Directory of Unix socket upstreams for /socket/:name (default: ~/.hpc-proxy/sockets)")
+	flag.StringVar(&discoveryFile, "discovery-file", "", "Also write a JSON discovery document (port, host, PID, version, token, SLURM job) to this file")
+	flag.BoolVar(&skipOwnerCheck, "skip-owner-check", false, "Allow proxying to ports owned by other users (disables UID check)")
+	flag.BoolVar(&tokenAuth, "token-auth", false, "Require a random shared-secret token (written to the port file) on every request")
+	flag.BoolVar(&replace, "replace", false, "Take over from an already running instance instead of exiting")
 	flag.BoolVar(&verbose, "verbose", false, "Enable verbose logging")
 	flag.BoolVar(&showVersion, "version", false, "Print version and exit")
 }
@@ -47,17 +88,69 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Default port file location
-	if portFile == "" {
+	// Default port file and socket directory locations
+	if portFile == "" || socketDir == "" {
 		home, err := os.UserHomeDir()
 		if err != nil {
 			log.Fatalf("Cannot determine home directory: %v", err)
 		}
-		portFile = filepath.Join(home, ".hpc-proxy", "port")
+		if portFile == "" {
+			portFile = filepath.Join(home, ".hpc-proxy", "port")
+		}
+		if socketDir == "" {
+			socketDir = filepath.Join(home, ".hpc-proxy", "sockets")
+		}
+	}
+	if err := os.MkdirAll(socketDir, 0700); err != nil {
+		log.Fatalf("Cannot create socket directory: %v", err)
+	}
+
+	// Only one proxy per port file: a second job on the same node would
+	// otherwise overwrite the file and strand the manager's tunnel
+	lock, err := claimInstance(portFile, replace)
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
+	defer lock.Release()
 
 	// Create proxy server
 	proxy := NewProxy(port, baseRewrite, verbose)
+	proxy.ownerCheck = !skipOwnerCheck
+	proxy.autoRewrite = autoRewrite
+	proxy.socketDir = socketDir
+	proxy.cookieNamespace = cookieNS
+	proxy.externalPrefix = normalizeExternalPrefix(externalPrefix)
+	proxy.startupWait = startupWait
+	proxy.startupGrace = startupGrace
+	proxy.compress = compressConfig{
+		types:   parseCompressTypes(compressTypes),
+		minSize: compressMinSize,
+	}
+	for _, ps := range []struct {
+		flag  string
+		value string
+		set   *portSet
+	}{
+		{"--shim-ports", shimPorts, &proxy.shim},
+		{"--host-rewrite-ports", hostRewritePorts, &proxy.hostRewrite},
+		{"--origin-rewrite-ports", originRewritePorts, &proxy.originRewrite},
+		{"--origin-drop-ports", originDropPorts, &proxy.originDrop},
+		{"--h2c-ports", h2cPorts, &proxy.h2cPorts},
+	} {
+		if *ps.set, err = parsePortSet(ps.value); err != nil {
+			log.Fatalf("Invalid %s: %v", ps.flag, err)
+		}
+	}
+	if proxy.tlsVerify, err = parseTLSVerifyMode(upstreamTLS); err != nil {
+		log.Fatalf("Invalid --upstream-tls: %v", err)
+	}
+	if tokenAuth {
+		token, err := generateToken()
+		if err != nil {
+			log.Fatalf("Failed to generate auth token: %v", err)
+		}
+		proxy.token = token
+	}
 
 	// Start listening (may auto-assign port if port=0)
 	actualPort, err := proxy.Start()
@@ -66,14 +159,35 @@ func main() {
 	}
 
 	// Write port to file for tunnel discovery
-	if err := writePortFile(portFile, actualPort); err != nil {
+	portContent := portFileContent(actualPort, proxy.token)
+	if err := writePortFile(portFile, actualPort, proxy.token); err != nil {
 		log.Fatalf("Failed to write port file: %v", err)
 	}
+	var discoveryContent []byte
+	if discoveryFile != "" {
+		discoveryContent, err = writeDiscoveryFile(discoveryFile, newDiscoveryInfo(actualPort, proxy.token))
+		if err != nil {
+			log.Fatalf("Failed to write discovery file: %v", err)
+		}
+		log.Printf("Discovery file: %s", discoveryFile)
+	}
 
-	log.Printf("HPC Proxy listening on :%d (port file: %s)", actualPort, portFile)
+	log.Printf("HPC Proxy listening on :%d (port file: %s, sockets: %s)", actualPort, portFile, socketDir)
 	if baseRewrite {
 		log.Printf("Base tag rewriting enabled")
 	}
+	if autoRewrite {
+		log.Printf("Per-service rewrite selection enabled")
+	}
+	if shimPorts != "" {
+		log.Printf("Client-side URL shim enabled for ports: %s", shimPorts)
+	}
+	if tokenAuth {
+		log.Printf("Token authentication enabled (token in port file)")
+	}
+	if skipOwnerCheck {
+		log.Printf("WARNING: port ownership check disabled - other users' services are reachable")
+	}
 
 	// Wait for shutdown signal
 	sigChan := make(chan os.Signal, 1)
@@ -83,18 +197,31 @@ func main() {
 	log.Println("Shutting down...")
 	proxy.Shutdown()
 
-	// Clean up port file
-	os.Remove(portFile)
+	// Clean up port and discovery files, unless a replacement instance has
+	// already rewritten them
+	removeIfOwned(portFile, portContent)
+	if discoveryFile != "" {
+		removeIfOwned(discoveryFile, discoveryContent)
+	}
 }
 
-func writePortFile(path string, port int) error {
-	// Ensure directory exists
-	dir := filepath.Dir(path)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("create directory: %w", err)
+// writePortFile writes the port on the first line and, when token auth is
+// enabled, the token on the second. Readers that only parse a leading
+// integer (the manager's parseInt) keep working unchanged.
+func writePortFile(path string, port int, token string) error {
+	perm := os.FileMode(0644)
+	if token != "" {
+		// The token is a credential - keep it private to the user
+		perm = 0600
 	}
+	return writeFileAtomic(path, portFileContent(port, token), perm)
+}
 
-	// Write port atomically
+// portFileContent returns the exact bytes written by writePortFile
+func portFileContent(port int, token string) []byte {
 	content := fmt.Sprintf("%d\n", port)
-	return os.WriteFile(path, []byte(content), 0644)
+	if token != "" {
+		content += token + "\n"
+	}
+	return []byte(content)
 }
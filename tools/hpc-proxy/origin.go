@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// originPolicy is what happens to Origin and Referer on upstream requests
+type originPolicy int
+
+const (
+	originKeep    originPolicy = iota // forward as the browser sent them
+	originRewrite                     // point them at the upstream address
+	originDrop                        // remove them
+)
+
+// originPolicy returns the configured Origin/Referer handling for port
+func (p *Proxy) originPolicy(port int) originPolicy {
+	switch {
+	case p.originDrop.has(port):
+		return originDrop
+	case p.originRewrite.has(port):
+		return originRewrite
+	}
+	return originKeep
+}
+
+// setUpstreamIdentity makes a request look like it came straight to the
+// upstream, for dev servers that check where requests are addressed:
+// Vite and webpack-dev-server reject unknown Host headers ("Blocked
+// request. This host is not allowed"), and Jupyter and Shiny refuse
+// WebSockets whose Origin does not match the Host. upstreamHost is the
+// address dialled, e.g. 127.0.0.1:5173, over req.URL.Scheme. A rewritten
+// Origin names whatever Host is sent, so it matches with or without host
+// rewriting.
+func setUpstreamIdentity(req *http.Request, route routeContext, upstreamHost string) {
+	if route.hostRewrite {
+		req.Host = upstreamHost
+	}
+
+	switch route.origin {
+	case originDrop:
+		req.Header.Del("Origin")
+		req.Header.Del("Referer")
+	case originRewrite:
+		host := req.Host
+		if host == "" {
+			// Sent as the URL's host, the address dialled
+			host = upstreamHost
+		}
+		base := req.URL.Scheme + "://" + host
+		if req.Header.Get("Origin") != "" {
+			req.Header.Set("Origin", base)
+		}
+		if referer := req.Header.Get("Referer"); referer != "" {
+			req.Header.Set("Referer", base+upstreamRefererPath(referer, route))
+		}
+	}
+}
+
+// upstreamRefererPath returns the path, with query, the upstream would
+// have seen for a Referer pointing through the route
+func upstreamRefererPath(referer string, route routeContext) string {
+	u, err := url.Parse(referer)
+	if err != nil {
+		return "/"
+	}
+	path := u.EscapedPath()
+	if !route.preserve {
+		if path == route.prefix {
+			path = "/"
+		} else if strings.HasPrefix(path, route.prefix+"/") {
+			path = strings.TrimPrefix(path, route.prefix)
+		}
+	}
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	return path
+}
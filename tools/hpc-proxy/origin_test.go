@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// hostCheckingBackend behaves like a dev server with host and origin
+// checks: the Host must be one of its own addresses (Vite), and any Origin
+// must match the Host (Jupyter). WebSocket upgrades are accepted once the
+// checks pass. The Referer seen last is recorded.
+func hostCheckingBackend(t *testing.T) (port string, referer *string) {
+	t.Helper()
+	referer = new(string)
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := srv.Listener.Addr().(*net.TCPAddr)
+		allowed := map[string]bool{
+			addr.String():                          true,
+			fmt.Sprintf("localhost:%d", addr.Port): true,
+		}
+		if !allowed[r.Host] {
+			http.Error(w, "Blocked request. This host is not allowed", http.StatusForbidden)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" && origin != "http://"+r.Host {
+			http.Error(w, "Cross-origin request blocked", http.StatusForbidden)
+			return
+		}
+		*referer = r.Header.Get("Referer")
+		if !isWebSocketUpgrade(r) {
+			fmt.Fprint(w, "ok")
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://127.0.0.1:"), referer
+}
+
+func TestProxyHostRewrite(t *testing.T) {
+	backendPort, referer := hostCheckingBackend(t)
+
+	tests := []struct {
+		name        string
+		hostPorts   string
+		rewritePort string
+		dropPort    string
+		origin      string
+		wantStatus  int
+		wantReferer string
+		host        string // Host the client sends, localhost:9001 if empty
+	}{
+		{"host check rejects proxied Host", "", "", "", "", http.StatusForbidden, "", ""},
+		{"host rewritten", backendPort, "", "", "", http.StatusOK, "https://manager.example/port/" + backendPort + "/lab?x=1", ""},
+		{"origin check rejects manager origin", backendPort, "", "", "https://manager.example", http.StatusForbidden, "", ""},
+		{"origin rewritten", backendPort, backendPort, "", "https://manager.example", http.StatusOK, "http://127.0.0.1:" + backendPort + "/lab?x=1", ""},
+		{"origin rewritten to unrewritten Host", "", backendPort, "", "https://manager.example", http.StatusOK, "http://localhost:" + backendPort + "/lab?x=1", "localhost:" + backendPort},
+		{"origin dropped", backendPort, "", backendPort, "https://manager.example", http.StatusOK, "", ""},
+		{"other ports untouched", "1", "1", "", "", http.StatusForbidden, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProxy(0, false, false)
+			p.ownerCheck = false
+			p.hostRewrite, _ = parsePortSet(tt.hostPorts)
+			p.originRewrite, _ = parsePortSet(tt.rewritePort)
+			p.originDrop, _ = parsePortSet(tt.dropPort)
+
+			*referer = ""
+			req := httptest.NewRequest("GET", "/port/"+backendPort+"/api/status", nil)
+			req.Host = "localhost:9001"
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			req.Header.Set("Referer", "https://manager.example/port/"+backendPort+"/lab?x=1")
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if w.Code == http.StatusOK && *referer != tt.wantReferer {
+				t.Errorf("upstream Referer = %q, want %q", *referer, tt.wantReferer)
+			}
+		})
+	}
+}
+
+func TestProxyHostRewriteWebSocket(t *testing.T) {
+	backendPort, _ := hostCheckingBackend(t)
+
+	p := NewProxy(0, false, false)
+	p.ownerCheck = false
+	p.hostRewrite, _ = parsePortSet(backendPort)
+	p.originRewrite, _ = parsePortSet(backendPort)
+	port, err := p.Start()
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer p.Shutdown()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /port/%s/api/kernels/1/channels HTTP/1.1\r\nHost: localhost:%d\r\nOrigin: http://localhost:%d\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n", backendPort, port, port)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("read upgrade response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 101, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestUpstreamRefererPath(t *testing.T) {
+	route := routeContext{prefix: "/port/8888"}
+	tests := []struct {
+		referer string
+		want    string
+	}{
+		{"https://m/port/8888/lab?x=1", "/lab?x=1"},
+		{"https://m/port/8888", "/"},
+		{"https://m/elsewhere", "/elsewhere"},
+	}
+	for _, tt := range tests {
+		if got := upstreamRefererPath(tt.referer, route); got != tt.want {
+			t.Errorf("upstreamRefererPath(%q) = %q, want %q", tt.referer, got, tt.want)
+		}
+	}
+
+	route = routeContext{prefix: "/absport/8888", preserve: true}
+	if got := upstreamRefererPath("https://m/absport/8888/lab", route); got != "/absport/8888/lab" {
+		t.Errorf("upstreamRefererPath() with preserved prefix = %q", got)
+	}
+}
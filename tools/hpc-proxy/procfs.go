@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// tcpListenState is the kernel's TCP_LISTEN state as printed in /proc/net/tcp
+const tcpListenState = "0A"
+
+// errPortNotOwned is returned when a listening port belongs to another user
+var errPortNotOwned = errors.New("port owned by another user")
+
+// socketEntry is a single row of /proc/net/tcp or /proc/net/tcp6
+type socketEntry struct {
+	IP    net.IP
+	Port  int
+	State string
+	UID   int
+	Inode uint64
+}
+
+// procFS reads socket and process information from a procfs mount.
+// root is normally /proc, but tests point it at a fake directory tree.
+type procFS struct {
+	root string
+}
+
+// listeningSockets returns all TCP sockets (IPv4 and IPv6) in LISTEN state
+func (fs procFS) listeningSockets() ([]socketEntry, error) {
+	var all []socketEntry
+	found := false
+	for _, name := range []string{"tcp", "tcp6"} {
+		f, err := os.Open(filepath.Join(fs.root, "net", name))
+		if err != nil {
+			// tcp6 is absent when IPv6 is disabled on the node
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		entries, err := parseProcNetTCP(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", name, err)
+		}
+		found = true
+		for _, e := range entries {
+			if e.State == tcpListenState {
+				all = append(all, e)
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no socket tables under %s/net", fs.root)
+	}
+	return all, nil
+}
+
+// portOwners reports the UIDs of all LISTEN sockets on port, whatever
+// address they are bound to, since the proxy falls back to the node's own
+// addresses when nothing answers on loopback
+func (fs procFS) portOwners(port int) ([]int, error) {
+	sockets, err := fs.listeningSockets()
+	if err != nil {
+		return nil, err
+	}
+	var uids []int
+	for _, s := range sockets {
+		if s.Port == port {
+			uids = append(uids, s.UID)
+		}
+	}
+	return uids, nil
+}
+
+// socketPIDs maps socket inodes to the PIDs holding them by scanning
+// /proc/<pid>/fd. Only processes readable by the caller are visible, which
+// on a shared node means the proxy user's own processes.
+func (fs procFS) socketPIDs() map[uint64]int {
+	pids := make(map[uint64]int)
+	dirs, err := os.ReadDir(fs.root)
+	if err != nil {
+		return pids
+	}
+	for _, d := range dirs {
+		pid, err := strconv.Atoi(d.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join(fs.root, d.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]"), 10, 64)
+			if err != nil {
+				continue
+			}
+			if _, seen := pids[inode]; !seen {
+				pids[inode] = pid
+			}
+		}
+	}
+	return pids
+}
+
+// cmdline returns the space-joined command line of pid, or "" if unreadable
+func (fs procFS) cmdline(pid int) string {
+	data, err := os.ReadFile(filepath.Join(fs.root, strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return ""
+	}
+	args := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+	return strings.Join(args, " ")
+}
+
+// portCommand returns the command line of the process of uid listening on
+// port, or "" if there is none or it is not visible
+func (fs procFS) portCommand(port, uid int) string {
+	sockets, err := fs.listeningSockets()
+	if err != nil {
+		return ""
+	}
+	var pids map[uint64]int
+	for _, s := range sockets {
+		if s.Port != port || s.UID != uid {
+			continue
+		}
+		if pids == nil {
+			pids = fs.socketPIDs()
+		}
+		if pid, ok := pids[s.Inode]; ok {
+			return fs.cmdline(pid)
+		}
+	}
+	return ""
+}
+
+// checkPortOwner returns errPortNotOwned if any listener on port belongs
+// to a UID other than uid. A port with no listener passes,
+// so the caller reports the usual "unavailable" error instead of a 403.
+func (fs procFS) checkPortOwner(port, uid int) error {
+	owners, err := fs.portOwners(port)
+	if err != nil {
+		return fmt.Errorf("read socket table: %w", err)
+	}
+	for _, owner := range owners {
+		if owner != uid {
+			return errPortNotOwned
+		}
+	}
+	return nil
+}
+
+// parseProcNetTCP parses the /proc/net/tcp{,6} table format:
+//
+//	sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+//	 0: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 12345 ...
+func parseProcNetTCP(r io.Reader) ([]socketEntry, error) {
+	var entries []socketEntry
+	scanner := bufio.NewScanner(r)
+	first := true
+	for scanner.Scan() {
+		if first {
+			// Skip header line
+			first = false
+			continue
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		ip, port, err := parseHexAddr(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		uid, err := strconv.Atoi(fields[7])
+		if err != nil {
+			return nil, fmt.Errorf("bad uid %q: %w", fields[7], err)
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad inode %q: %w", fields[9], err)
+		}
+		entries = append(entries, socketEntry{
+			IP:    ip,
+			Port:  port,
+			State: fields[3],
+			UID:   uid,
+			Inode: inode,
+		})
+	}
+	return entries, scanner.Err()
+}
+
+// parseHexAddr decodes "0100007F:1F90" (IPv4) or the 32-digit IPv6 form.
+// The kernel prints each 32-bit word of the address in host byte order,
+// so on little-endian hosts (x86_64, aarch64) every word is byte-reversed.
+func parseHexAddr(s string) (net.IP, int, error) {
+	host, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, 0, fmt.Errorf("bad address %q", s)
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("bad port in %q: %w", s, err)
+	}
+	raw, err := hex.DecodeString(host)
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("bad address %q", s)
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	return ip, int(port), nil
+}
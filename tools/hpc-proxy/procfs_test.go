@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const procNetHeader = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+
+// writeFakeProc creates a fake procfs root containing net/tcp and net/tcp6
+func writeFakeProc(t *testing.T, tcp, tcp6 string) string {
+	t.Helper()
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "net"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "net", "tcp"), []byte(procNetHeader+tcp), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if tcp6 != "" {
+		if err := os.WriteFile(filepath.Join(root, "net", "tcp6"), []byte(procNetHeader+tcp6), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestParseHexAddr(t *testing.T) {
+	tests := []struct {
+		input    string
+		wantIP   string
+		wantPort int
+	}{
+		{"0100007F:1F90", "127.0.0.1", 8080},
+		{"00000000:157C", "0.0.0.0", 5500},
+		{"00000000000000000000000001000000:0EF6", "::1", 3830},
+		{"00000000000000000000000000000000:0016", "::", 22},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			ip, port, err := parseHexAddr(tt.input)
+			if err != nil {
+				t.Fatalf("parseHexAddr(%q) error = %v", tt.input, err)
+			}
+			if ip.String() != tt.wantIP {
+				t.Errorf("parseHexAddr(%q) ip = %s, want %s", tt.input, ip, tt.wantIP)
+			}
+			if port != tt.wantPort {
+				t.Errorf("parseHexAddr(%q) port = %d, want %d", tt.input, port, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestCheckPortOwner(t *testing.T) {
+	tcp := strings.Join([]string{
+		// 127.0.0.1:5500 LISTEN uid 1000
+		"   0: 0100007F:157C 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 1001 1 0000000000000000 100 0 0 10 0",
+		// 0.0.0.0:3838 LISTEN uid 2000
+		"   1: 00000000:0EFE 00000000:0000 0A 00000000:00000000 00:00000000 00000000  2000        0 1002 1 0000000000000000 100 0 0 10 0",
+		// 10.0.0.5:8080 LISTEN uid 2000 (reachable via the node address fallback)
+		"   2: 0500000A:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000  2000        0 1003 1 0000000000000000 100 0 0 10 0",
+		// 127.0.0.1:4000 ESTABLISHED uid 2000 (client side, not a listener)
+		"   3: 0100007F:0FA0 0100007F:157C 01 00000000:00000000 00:00000000 00000000  2000        0 1004 1 0000000000000000 100 0 0 10 0",
+	}, "\n") + "\n"
+	tcp6 := strings.Join([]string{
+		// [::1]:5173 LISTEN uid 2000
+		"   0: 00000000000000000000000001000000:1435 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000  2000        0 1005 1 0000000000000000 100 0 0 10 0",
+	}, "\n") + "\n"
+	fs := procFS{root: writeFakeProc(t, tcp, tcp6)}
+
+	tests := []struct {
+		name    string
+		port    int
+		wantErr error
+	}{
+		{"own loopback listener", 5500, nil},
+		{"other user wildcard listener", 3838, errPortNotOwned},
+		{"other user ipv6 loopback listener", 5173, errPortNotOwned},
+		{"other user node address listener", 8080, errPortNotOwned},
+		{"established socket ignored", 4000, nil},
+		{"nothing listening", 9999, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := fs.checkPortOwner(tt.port, 1000)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("checkPortOwner(%d) error = %v, want %v", tt.port, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckPortOwnerMissingProc(t *testing.T) {
+	fs := procFS{root: filepath.Join(t.TempDir(), "missing")}
+	err := fs.checkPortOwner(5500, 1000)
+	if err == nil || errors.Is(err, errPortNotOwned) {
+		t.Errorf("expected read error for missing procfs, got %v", err)
+	}
+}
+
+func TestProxyRefusesForeignPort(t *testing.T) {
+	// 0.0.0.0:3838 LISTEN uid 2000
+	tcp := "   0: 00000000:0EFE 00000000:0000 0A 00000000:00000000 00:00000000 00000000  2000        0 1002 1 0000000000000000 100 0 0 10 0\n"
+
+	p := NewProxy(0, false, false)
+	p.uid = 1000
+	p.procfs = procFS{root: writeFakeProc(t, tcp, "")}
+
+	req := httptest.NewRequest("GET", "/port/3838/", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected status 403, got %d", w.Code)
+	}
+
+	// Opting out of the check lets the request through to the (absent) upstream
+	p.ownerCheck = false
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if w.Code == http.StatusForbidden {
+		t.Errorf("expected ownership check to be skipped, got 403")
+	}
+}
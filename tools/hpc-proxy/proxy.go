@@ -1,31 +1,29 @@
 package main
 
 import (
-	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
-	"html"
 	"io"
 	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+
+	"golang.org/x/net/http2"
 )
 
 // Pre-compiled regexes for performance
 var (
 	routePattern = regexp.MustCompile(`^/port/(\d+)(/.*)?$`)
-	headPattern  = regexp.MustCompile(`(?i)(<head[^>]*>)`)
-	// Match existing base tag to avoid duplicates
-	baseTagPattern = regexp.MustCompile(`(?i)<base\s+[^>]*href=`)
-	// Match href="/..." and src="/..." (absolute paths starting with single /)
-	// Captures: $1 = attribute prefix (e.g., href="), $2 = the path (e.g., /foo/bar)
-	absPathPattern = regexp.MustCompile(`((?:href|src|action)=["'])(/[^"']*)`)
+	// absRoutePattern matches /absport/:port/*, forwarded with the path intact
+	absRoutePattern = regexp.MustCompile(`^/absport/(\d+)(/.*)?$`)
+	// tlsRoutePattern matches /sport/:port/*, forwarded over HTTPS
+	tlsRoutePattern = regexp.MustCompile(`^/sport/(\d+)(/.*)?$`)
 )
 
 // Proxy handles HTTP/WebSocket reverse proxying with path-based routing
@@ -35,6 +33,65 @@ type Proxy struct {
 	verbose     bool
 	server      *http.Server
 	listener    net.Listener
+
+	// Ownership check: refuse to proxy ports whose listener belongs to
+	// another user on the same node (enabled by default)
+	ownerCheck bool
+	uid        int
+	procfs     procFS
+
+	// Shared-secret token required on every request (empty disables auth)
+	token string
+
+	// Per-service rewrite policy based on fingerprinting the upstream
+	autoRewrite  bool
+	fingerprints *fingerprintCache
+
+	// Remembers which local address each target port answered on
+	upstreams *upstreamResolver
+
+	// How long the holding page waits for a port that is not up yet (0
+	// disables it), and how long other requests are held for it
+	startupWait  time.Duration
+	startupGrace time.Duration
+	startups     *startingReloads
+
+	// Directory of Unix socket upstreams for /socket/:name (empty disables)
+	socketDir string
+
+	// Ports whose HTML gets the client-side URL shim (opt-in)
+	shim portSet
+
+	// Prefix cookie names per route, on top of scoping their Path
+	cookieNamespace bool
+
+	// Ports whose dev servers check Host and Origin (opt-in): the upstream
+	// address is sent as Host, and Origin/Referer are rewritten or dropped
+	hostRewrite   portSet
+	originRewrite portSet
+	originDrop    portSet
+
+	// Path the manager mounts the proxy under, e.g. /hpc/node01 (empty for
+	// the root); prepended to every URL handed to the browser
+	externalPrefix string
+
+	// Which responses are compressed for the client on the way out
+	compress compressConfig
+
+	// How certificates of /sport upstreams are checked, and the
+	// certificates pinned on first use
+	tlsVerify tlsVerifyMode
+	certPins  *certPins
+
+	// Ports spoken to in HTTP/2 cleartext (opt-in); gRPC calls always are
+	h2cPorts portSet
+
+	// Cached ReverseProxy per upstream target, sharing one tuned transport
+	// per protocol
+	registry     *proxyRegistry
+	transport    *http.Transport
+	h2cTransport *http2.Transport
+	stopSweep    chan struct{}
 }
 
 // NewProxy creates a new proxy instance
@@ -43,6 +100,23 @@ func NewProxy(port int, baseRewrite, verbose bool) *Proxy {
 		port:        port,
 		baseRewrite: baseRewrite,
 		verbose:     verbose,
+		ownerCheck:  true,
+		uid:         os.Getuid(),
+		procfs:      procFS{root: "/proc"},
+
+		fingerprints: newFingerprintCache(),
+		upstreams:    newUpstreamResolver(),
+		startupWait:  defaultStartupWait,
+		startups:     newStartingReloads(),
+		tlsVerify:    tlsVerifyPin,
+		certPins:     newCertPins(),
+		registry:     newProxyRegistry(),
+		transport:    newUpstreamTransport(),
+		h2cTransport: newH2CTransport(),
+		compress: compressConfig{
+			types:   parseCompressTypes(defaultCompressTypes),
+			minSize: defaultCompressMinSize,
+		},
 	}
 }
 
@@ -61,10 +135,12 @@ func (p *Proxy) Start() (int, error) {
 	p.port = actualPort
 
 	p.server = &http.Server{
-		Handler:      p,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 0, // Disable for WebSocket/SSE
-		IdleTimeout:  120 * time.Second,
+		Handler: h2cHandler(p),
+		// Only headers are bounded: request bodies may stream for as long
+		// as the upstream reads them (uploads, gRPC client streams)
+		ReadHeaderTimeout: 30 * time.Second,
+		WriteTimeout:      0, // Disable for WebSocket/SSE
+		IdleTimeout:       120 * time.Second,
 	}
 
 	go func() {
@@ -73,6 +149,9 @@ func (p *Proxy) Start() (int, error) {
 		}
 	}()
 
+	p.stopSweep = make(chan struct{})
+	go p.sweepRegistry(p.stopSweep)
+
 	return actualPort, nil
 }
 
@@ -83,20 +162,71 @@ func (p *Proxy) Shutdown() {
 		defer cancel()
 		p.server.Shutdown(ctx)
 	}
+	if p.stopSweep != nil {
+		close(p.stopSweep)
+		p.stopSweep = nil
+	}
+	// Evict every cached proxy (maxIdle 0) to release socket transports
+	p.registry.sweep(nil, 0)
+	p.transport.CloseIdleConnections()
+	p.h2cTransport.CloseIdleConnections()
 }
 
 // ServeHTTP handles all incoming requests (HTTP and WebSocket)
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Parse route: /port/:port/*
+	// Liveness probe used by the manager and by new instances at startup
+	if r.URL.Path == healthPath {
+		p.serveHealth(w, r)
+		return
+	}
+
+	// Other users on the node can reach the listener, so check the token first
+	if !p.authenticate(w, r) {
+		return
+	}
+
+	// Proxy's own API (port listing etc.)
+	if strings.HasPrefix(r.URL.Path, internalPrefix) {
+		p.serveInternal(w, r)
+		return
+	}
+
+	// Landing page listing the user's ports
+	if r.URL.Path == "/" {
+		p.serveIndex(w, r)
+		return
+	}
+
+	// Unix socket upstreams: /socket/:name/*
+	if name, remainingPath, ok := parseSocketRoute(r.URL.Path); ok {
+		p.handleSocket(w, r, name, remainingPath)
+		return
+	}
+
+	// Prefix-preserving route: /absport/:port/*
+	if targetPort, ok := parseAbsRoute(r.URL.Path); ok {
+		if !p.checkPort(w, r, targetPort) {
+			return
+		}
+		if p.verbose {
+			log.Printf("%s %s -> localhost:%d%s", r.Method, r.URL.Path, targetPort, p.externalPrefix+r.URL.Path)
+		}
+		p.handleAbsHTTP(w, r, targetPort)
+		return
+	}
+
+	// Parse route: /port/:port/*, or /sport/:port/* for HTTPS upstreams
 	targetPort, remainingPath, ok := p.parseRoute(r.URL.Path)
+	secure := false
+	if !ok {
+		targetPort, remainingPath, ok = parseTLSRoute(r.URL.Path)
+		secure = ok
+	}
 	if !ok {
-		http.Error(w, "Invalid route. Use /port/:port/path", http.StatusBadRequest)
+		http.Error(w, "Invalid route. Use /port/:port/path, /sport/:port/path, /absport/:port/path or /socket/:name/path", http.StatusBadRequest)
 		return
 	}
-
-	// Validate port
-	if targetPort < 1 || targetPort > 65535 {
-		http.Error(w, "Invalid port number", http.StatusBadRequest)
+	if !p.checkPort(w, r, targetPort) {
 		return
 	}
 
@@ -105,12 +235,47 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Proxy HTTP/WebSocket request (httputil.ReverseProxy handles both in Go 1.21+)
-	p.handleHTTP(w, r, targetPort, remainingPath)
+	p.handleHTTP(w, r, targetPort, remainingPath, secure)
+}
+
+// checkPort validates a target port and refuses ports owned by other
+// users. It writes the error response and returns false on failure.
+func (p *Proxy) checkPort(w http.ResponseWriter, r *http.Request, targetPort int) bool {
+	// Validate port
+	if targetPort < 1 || targetPort > 65535 {
+		http.Error(w, "Invalid port number", http.StatusBadRequest)
+		return false
+	}
+
+	// Refuse to expose another user's service on a shared node
+	if p.ownerCheck {
+		if err := p.procfs.checkPortOwner(targetPort, p.uid); err != nil {
+			if errors.Is(err, errPortNotOwned) {
+				log.Printf("Refusing port %d: %v", targetPort, err)
+			} else {
+				log.Printf("Ownership check failed for port %d: %v", targetPort, err)
+				err = fmt.Errorf("%w: %v", errOwnerUnknown, err)
+			}
+			p.serveFailure(w, r, p.diagnose(upstreamTarget{port: targetPort}, err))
+			return false
+		}
+	}
+	return true
 }
 
 // parseRoute extracts port and path from /port/:port/remaining/path
 func (p *Proxy) parseRoute(path string) (port int, remaining string, ok bool) {
-	matches := routePattern.FindStringSubmatch(path)
+	return matchPortRoute(routePattern, path)
+}
+
+// parseTLSRoute extracts port and path from /sport/:port/remaining/path
+func parseTLSRoute(path string) (port int, remaining string, ok bool) {
+	return matchPortRoute(tlsRoutePattern, path)
+}
+
+// matchPortRoute extracts port and remaining path from a port route
+func matchPortRoute(pattern *regexp.Regexp, path string) (port int, remaining string, ok bool) {
+	matches := pattern.FindStringSubmatch(path)
 	if matches == nil {
 		return 0, "", false
 	}
@@ -128,79 +293,102 @@ func (p *Proxy) parseRoute(path string) (port int, remaining string, ok bool) {
 	return port, remaining, true
 }
 
-// handleHTTP proxies HTTP and WebSocket requests using httputil.ReverseProxy
-func (p *Proxy) handleHTTP(w http.ResponseWriter, r *http.Request, targetPort int, path string) {
-	target := &url.URL{
-		Scheme: "http",
-		Host:   fmt.Sprintf("127.0.0.1:%d", targetPort),
-	}
-
-	proxy := httputil.NewSingleHostReverseProxy(target)
-
-	// Customize director to rewrite path
-	originalDirector := proxy.Director
-	proxy.Director = func(req *http.Request) {
-		originalDirector(req)
-		req.URL.Path = path
-		req.URL.RawPath = path
-		// Preserve query string
-		req.URL.RawQuery = r.URL.RawQuery
-		// Set X-Forwarded headers
-		req.Header.Set("X-Forwarded-Host", r.Host)
-		// Detect protocol from existing header or TLS state
-		proto := r.Header.Get("X-Forwarded-Proto")
-		if proto == "" {
-			if r.TLS != nil {
-				proto = "https"
-			} else {
-				proto = "http"
-			}
-		}
-		req.Header.Set("X-Forwarded-Proto", proto)
-		req.Header.Set("X-Original-Path", r.URL.Path)
+// parseAbsRoute extracts the port from /absport/:port/remaining/path
+func parseAbsRoute(path string) (port int, ok bool) {
+	matches := absRoutePattern.FindStringSubmatch(path)
+	if matches == nil {
+		return 0, false
+	}
+	port, err := strconv.Atoi(matches[1])
+	if err != nil {
+		return 0, false
 	}
+	return port, true
+}
 
-	// Optionally modify response for redirect and HTML rewriting
-	// Pass the original path so base tag can be set correctly for subdirectories
-	originalPath := r.URL.Path
-	if p.baseRewrite {
-		proxy.ModifyResponse = func(resp *http.Response) error {
-			return p.rewriteResponse(resp, targetPort, originalPath)
-		}
+// handleHTTP proxies HTTP and WebSocket requests to a TCP port, over
+// HTTPS when secure is set
+func (p *Proxy) handleHTTP(w http.ResponseWriter, r *http.Request, targetPort int, path string, secure bool) {
+	// Find the address the service listens on (127.0.0.1, ::1, node IPs)
+	upstreamAddr, ok := p.resolveUpstream(w, r, targetPort)
+	if !ok {
+		return
 	}
 
-	// Handle errors
-	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		log.Printf("Proxy error to port %d: %v", targetPort, err)
-		http.Error(w, fmt.Sprintf("Service on port %d unavailable", targetPort), http.StatusBadGateway)
+	route := "/port/"
+	if secure {
+		route = "/sport/"
 	}
+	rewrite := p.shouldRewriteHTML(targetPort)
+	p.forward(w, r, upstreamTarget{
+		host: upstreamAddr,
+		port: targetPort,
+		tls:  secure,
+	}, routeContext{
+		prefix: p.externalPrefix + route + strconv.Itoa(targetPort),
+		port:   targetPort,
+		path:   path,
+		// Services that handle their own URLs still need redirects prefixed
+		rewrite:     rewrite,
+		location:    !rewrite && p.autoRewrite,
+		shim:        p.shim.has(targetPort),
+		hostRewrite: p.hostRewrite.has(targetPort),
+		origin:      p.originPolicy(targetPort),
+		h2c:         p.h2cPorts.has(targetPort) || isGRPC(r),
+	})
+}
 
-	proxy.ServeHTTP(w, r)
+// handleAbsHTTP proxies /absport/:port requests with the path the browser
+// used left intact, for apps told their base path (Jupyter --ServerApp.base_url,
+// RStudio www-root-path, Shiny --root-path, Streamlit baseUrlPath). Such
+// apps generate correct URLs themselves, so bodies are never rewritten;
+// headers still are, which leaves correct URLs unchanged.
+func (p *Proxy) handleAbsHTTP(w http.ResponseWriter, r *http.Request, targetPort int) {
+	upstreamAddr, ok := p.resolveUpstream(w, r, targetPort)
+	if !ok {
+		return
+	}
+
+	p.forward(w, r, upstreamTarget{
+		host: upstreamAddr,
+		port: targetPort,
+	}, routeContext{
+		prefix:      p.externalPrefix + "/absport/" + strconv.Itoa(targetPort),
+		port:        targetPort,
+		path:        p.externalPrefix + r.URL.Path,
+		preserve:    true,
+		location:    true,
+		shim:        p.shim.has(targetPort),
+		hostRewrite: p.hostRewrite.has(targetPort),
+		origin:      p.originPolicy(targetPort),
+		h2c:         p.h2cPorts.has(targetPort) || isGRPC(r),
+	})
 }
 
-// rewriteResponse modifies responses to fix absolute URLs for path-based routing
-// This includes both HTML content and redirect Location headers
-// originalPath is the full request path (e.g., /port/5500/docs/) used to compute the base tag
-func (p *Proxy) rewriteResponse(resp *http.Response, targetPort int, originalPath string) error {
-	prefix := fmt.Sprintf("/port/%d", targetPort)
-
-	// Rewrite Location header for any response that has one (redirects, 201 Created, etc.)
-	if location := resp.Header.Get("Location"); location != "" {
-		// Only rewrite absolute paths (starting with /) that aren't already prefixed
-		if strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "/port/") {
-			newLocation := prefix + location
-			resp.Header.Set("Location", newLocation)
-			if p.verbose {
-				log.Printf("Rewrote Location header: %s -> %s", location, newLocation)
-			}
-		}
+// rewritePrefixed applies the rewriting a route asks for to a response,
+// for any route prefix (/port/:port or /socket/:name)
+func (p *Proxy) rewritePrefixed(resp *http.Response, route routeContext) error {
+	// Cookies are scoped to the route whatever the rewrite policy
+	p.rewriteSetCookies(resp, route.prefix)
+	if route.rewrite || route.location {
+		p.rewriteLocation(resp, route)
 	}
 
-	// Only process HTML content for body rewriting
+	// Only process HTML and CSS content for body rewriting
 	contentType := resp.Header.Get("Content-Type")
+	if route.rewrite && strings.Contains(contentType, "text/css") {
+		return p.rewriteCSS(resp, route.prefix)
+	}
 	if !strings.Contains(contentType, "text/html") {
 		return nil
 	}
+	if !route.rewrite {
+		// Apps that build their own URLs only get the shim, if enabled
+		if route.shim {
+			return p.editHTML(resp, htmlEdits{prefix: route.prefix, shim: true})
+		}
+		return nil
+	}
 
 	// Compute base path for relative URL resolution
 	// For /port/5500/docs/index.html -> base is /port/5500/docs/
@@ -208,7 +396,7 @@ func (p *Proxy) rewriteResponse(resp *http.Response, targetPort int, originalPat
 	// For /port/5500/ -> base is /port/5500/
 	// For /port/5500 -> base is /port/5500/ (treat as directory)
 	// For /index.html -> base is /
-	basePath := originalPath
+	basePath := route.originalPath
 	if !strings.HasSuffix(basePath, "/") {
 		// Check if this looks like a file (has extension) or directory
 		// Files: /port/5500/index.html, /foo.css -> strip filename
@@ -228,88 +416,58 @@ func (p *Proxy) rewriteResponse(resp *http.Response, targetPort int, originalPat
 		}
 	}
 
-	return p.rewriteHTML(resp, prefix, basePath)
+	return p.editHTML(resp, htmlEdits{
+		prefix:   route.prefix,
+		urls:     true,
+		basePath: basePath,
+		shim:     route.shim,
+	})
 }
 
-// rewriteHTML modifies HTML responses to rewrite absolute URLs for path-based routing
-// prefix is the port prefix (e.g., /port/5500) for rewriting absolute paths
-// basePath is the full directory path (e.g., /port/5500/docs/) for the base tag
-func (p *Proxy) rewriteHTML(resp *http.Response, prefix string, basePath string) error {
+// isRoutedPath reports whether path already carries a proxy route prefix
+func isRoutedPath(path, prefix string) bool {
+	mount := routeMount(prefix)
+	return strings.HasPrefix(path, mount+"/port/") || strings.HasPrefix(path, mount+"/sport/") ||
+		strings.HasPrefix(path, mount+"/absport/") || strings.HasPrefix(path, prefix+"/")
+}
 
+// editHTML rewrites an HTML response body as it streams through
+func (p *Proxy) editHTML(resp *http.Response, edits htmlEdits) error {
+	return rewriteBody(resp, func(r io.Reader, body io.Closer) io.ReadCloser {
+		return newHTMLRewriter(r, body, edits)
+	})
+}
 
-	// Handle compressed responses
-	encoding := resp.Header.Get("Content-Encoding")
-	var reader io.Reader = resp.Body
-	var isGzipped bool
+// rewriteCSS modifies stylesheet responses to prefix absolute url() and
+// @import references
+func (p *Proxy) rewriteCSS(resp *http.Response, prefix string) error {
+	return rewriteBody(resp, func(r io.Reader, body io.Closer) io.ReadCloser {
+		return newCSSRewriter(r, body, prefix)
+	})
+}
 
-	if encoding == "gzip" {
-		gzReader, err := gzip.NewReader(resp.Body)
-		if err != nil {
-			// Not actually gzipped, use original body
-			reader = resp.Body
-		} else {
-			reader = gzReader
-			isGzipped = true
-			defer gzReader.Close()
-		}
+// rewriteBody replaces the response body with a rewriter reading the
+// decoded body. The body is rewritten as it streams through, so its
+// length is not known. Bodies in an encoding the proxy cannot decode are
+// left untouched; bodies that fail to decode are an error.
+func rewriteBody(resp *http.Response, rewriter func(r io.Reader, body io.Closer) io.ReadCloser) error {
+	decoded, err := decodeBody(resp.Header.Get("Content-Encoding"), resp.Body)
+	if errors.Is(err, errUnsupportedEncoding) {
+		log.Printf("Not rewriting response: %v", err)
+		return nil
 	}
-
-	// Read body
-	body, err := io.ReadAll(reader)
-	resp.Body.Close()
 	if err != nil {
 		return err
 	}
 
-	bodyStr := string(body)
-
-	// Rewrite absolute paths: href="/foo" -> href="/port/5500/foo"
-	// This handles CSS, JS, links, images, forms with absolute paths
-	// Skip protocol-relative URLs (//...) and already-rewritten URLs (/port/...)
-	bodyStr = absPathPattern.ReplaceAllStringFunc(bodyStr, func(match string) string {
-		// Extract the path part (after the attribute prefix)
-		parts := absPathPattern.FindStringSubmatch(match)
-		if len(parts) < 3 {
-			return match
-		}
-		attrPrefix := parts[1] // e.g., href="
-		path := parts[2]       // e.g., /foo/bar
-
-		// Skip protocol-relative URLs (start with //)
-		if strings.HasPrefix(path, "//") {
-			return match
-		}
-		// Skip already-rewritten URLs
-		if strings.HasPrefix(path, "/port/") {
-			return match
-		}
-		return attrPrefix + prefix + path
-	})
+	resp.Body = rewriter(decoded, decoded)
 
-	// Inject base tag for relative URLs using the full path (not just prefix)
-	// This ensures relative paths like "deps/..." resolve correctly in subdirectories
-	// Skip if HTML already has a base tag to avoid invalid HTML with multiple base tags
-	if !baseTagPattern.MatchString(bodyStr) {
-		// HTML-escape basePath to prevent XSS via crafted URLs
-		baseTag := fmt.Sprintf(`<base href="%s">`, html.EscapeString(basePath))
-		if headPattern.MatchString(bodyStr) {
-			bodyStr = headPattern.ReplaceAllString(bodyStr, "${1}\n"+baseTag)
-		} else {
-			// Fallback: if there's no <head>, inject the base tag at the start of the document
-			bodyStr = baseTag + "\n" + bodyStr
-		}
-	}
-
-	// Update response (always return uncompressed for simplicity)
-	resp.Body = io.NopCloser(strings.NewReader(bodyStr))
-	resp.ContentLength = int64(len(bodyStr))
-	resp.Header.Set("Content-Length", strconv.Itoa(len(bodyStr)))
-	// Clear Transfer-Encoding since we now have a fixed Content-Length
+	// The decoded length is unknown; compressResponse re-encodes it for
+	// the client afterwards
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
 	resp.Header.Del("Transfer-Encoding")
 	resp.TransferEncoding = nil
-	if isGzipped {
-		resp.Header.Del("Content-Encoding")
-	}
-
+	resp.Header.Del("Content-Encoding")
 	return nil
 }
@@ -3,13 +3,27 @@ package main
 import (
 	"compress/gzip"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 )
 
+// rewriteResponse rewrites resp as a /port/:port route with rewriting on.
+// originalPath is the full request path (e.g., /port/5500/docs/) used to
+// compute the base tag.
+func (p *Proxy) rewriteResponse(resp *http.Response, targetPort int, originalPath string) error {
+	return p.rewritePrefixed(resp, routeContext{
+		prefix:       p.externalPrefix + "/port/" + strconv.Itoa(targetPort),
+		port:         targetPort,
+		originalPath: originalPath,
+		rewrite:      true,
+	})
+}
+
 func TestParseRoute(t *testing.T) {
 	p := NewProxy(0, false, false)
 
@@ -46,7 +60,7 @@ func TestParseRoute(t *testing.T) {
 	}
 }
 
-func TestAbsPathPatternRewriting(t *testing.T) {
+func TestRewriteHTMLAttributes(t *testing.T) {
 	tests := []struct {
 		name   string
 		input  string
@@ -131,25 +145,48 @@ func TestAbsPathPatternRewriting(t *testing.T) {
 			port:  5500,
 			want:  `<a href="/port/5500/api?param=value#anchor">link</a>`,
 		},
+		{
+			name:  "unquoted attribute",
+			input: `<a href=/foo class=x>link</a>`,
+			port:  5500,
+			want:  `<a href=/port/5500/foo class=x>link</a>`,
+		},
+		{
+			name:  "uppercase attribute name",
+			input: `<IMG SRC="/logo.png">`,
+			port:  5500,
+			want:  `<IMG SRC="/port/5500/logo.png">`,
+		},
+		{
+			name:  "script body untouched",
+			input: `<script>var s = '<a href="/foo">';</script>`,
+			port:  5500,
+			want:  `<script>var s = '<a href="/foo">';</script>`,
+		},
+		{
+			name:  "pre text untouched",
+			input: `<pre>href="/foo"</pre>`,
+			port:  5500,
+			want:  `<pre>href="/foo"</pre>`,
+		},
+		{
+			name:  "comment untouched",
+			input: `<!-- <a href="/foo"> -->`,
+			port:  5500,
+			want:  `<!-- <a href="/foo"> -->`,
+		},
+		{
+			name:  "non-URL attribute untouched",
+			input: `<div data-href="/foo" title="/bar">`,
+			port:  5500,
+			want:  `<div data-href="/foo" title="/bar">`,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			prefix := "/port/" + strconv.Itoa(tt.port)
-			// Use the same logic as rewriteHTML to handle filtering
-			result := absPathPattern.ReplaceAllStringFunc(tt.input, func(match string) string {
-				parts := absPathPattern.FindStringSubmatch(match)
-				if len(parts) < 3 {
-					return match
-				}
-				attrPrefix := parts[1]
-				path := parts[2]
-				// Skip protocol-relative URLs and already-rewritten URLs
-				if strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/port/") {
-					return match
-				}
-				return attrPrefix + prefix + path
-			})
+			result := rewriteHTMLString(t, tt.input, prefix, "")
 			if result != tt.want {
 				t.Errorf("rewrite(%q) = %q, want %q", tt.input, result, tt.want)
 			}
@@ -246,9 +283,8 @@ func TestRewriteHTMLGzipped(t *testing.T) {
 		Body: io.NopCloser(strings.NewReader(buf.String())),
 	}
 
-	err := p.rewriteHTML(resp, "/port/5500", "/port/5500/")
-	if err != nil {
-		t.Fatalf("rewriteHTML() error = %v", err)
+	if err := p.editHTML(resp, htmlEdits{prefix: "/port/5500", urls: true, basePath: "/port/5500/"}); err != nil {
+		t.Fatalf("editHTML() error = %v", err)
 	}
 
 	// Response should be decompressed
@@ -374,7 +410,7 @@ func TestRewriteResponseExistingBaseTag(t *testing.T) {
 	p := NewProxy(0, true, false)
 
 	// HTML already has a base tag - should not inject another
-	// Use relative href to avoid the absPathPattern rewriting it
+	// Use relative href so it is not rewritten
 	html := `<html><head><base href="./"></head><body></body></html>`
 	resp := &http.Response{
 		Header: http.Header{
@@ -511,3 +547,137 @@ func TestProxyInvalidPort(t *testing.T) {
 		})
 	}
 }
+
+func TestParseAbsRoute(t *testing.T) {
+	tests := []struct {
+		path     string
+		wantPort int
+		wantOk   bool
+	}{
+		{"/absport/8888/lab", 8888, true},
+		{"/absport/3838", 3838, true},
+		{"/absport/abc/", 0, false},
+		{"/port/8888/lab", 0, false},
+	}
+	for _, tt := range tests {
+		port, ok := parseAbsRoute(tt.path)
+		if port != tt.wantPort || ok != tt.wantOk {
+			t.Errorf("parseAbsRoute(%q) = %d, %v, want %d, %v", tt.path, port, ok, tt.wantPort, tt.wantOk)
+		}
+	}
+}
+
+func TestProxyAbsPortPreservesPath(t *testing.T) {
+	var gotPath, gotPrefix string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.RequestURI()
+		gotPrefix = r.Header.Get("X-Forwarded-Prefix")
+		if strings.HasSuffix(r.URL.Path, "/tree") {
+			http.Redirect(w, r, r.URL.Path[:len(r.URL.Path)-len("tree")]+"lab", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head></head><body><a href="/foo">link</a></body></html>`))
+	}))
+	defer backend.Close()
+	backendPort := strings.TrimPrefix(backend.URL, "http://127.0.0.1:")
+	route := "/absport/" + backendPort
+
+	// Rewriting on globally must not touch an app that knows its base path
+	p := NewProxy(0, true, false)
+	p.ownerCheck = false
+
+	req := httptest.NewRequest("GET", route+"/lab?x=1", nil)
+	req.Header.Set("X-Forwarded-Prefix", "/bogus")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if gotPath != route+"/lab?x=1" {
+		t.Errorf("upstream path = %q, want %q", gotPath, route+"/lab?x=1")
+	}
+	if gotPrefix != "" {
+		t.Errorf("upstream X-Forwarded-Prefix = %q, want none", gotPrefix)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `<a href="/foo">`) || strings.Contains(body, "<base") {
+		t.Errorf("expected body untouched, got: %s", body)
+	}
+
+	// Redirects already under the route are left as they are
+	req = httptest.NewRequest("GET", route+"/tree", nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if got := w.Header().Get("Location"); got != route+"/lab" {
+		t.Errorf("Location = %q, want %q", got, route+"/lab")
+	}
+
+	// The full external path is forwarded when mounted under the manager
+	p.externalPrefix = "/hpc/node01"
+	req = httptest.NewRequest("GET", route+"/lab", nil)
+	p.ServeHTTP(httptest.NewRecorder(), req)
+	if gotPath != "/hpc/node01"+route+"/lab" {
+		t.Errorf("upstream path = %q, want %q", gotPath, "/hpc/node01"+route+"/lab")
+	}
+}
+
+// assetBackend serves small CSS/JS assets like a pkgdown or Quarto site and
+// counts the upstream connections opened
+func assetBackend(b *testing.B) (*httptest.Server, string, *int64) {
+	b.Helper()
+	asset := strings.Repeat("x", 2048)
+	var conns int64
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/css")
+		w.Write([]byte(asset))
+	}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	backend.Start()
+	return backend, strings.TrimPrefix(backend.URL, "http://127.0.0.1:"), &conns
+}
+
+// benchmarkAssetPage fetches assets from many goroutines at once, as a
+// browser does when loading an asset-heavy page over several connections
+func benchmarkAssetPage(b *testing.B, p *Proxy, perRequest func()) {
+	backend, backendPort, conns := assetBackend(b)
+	defer backend.Close()
+	path := "/port/" + backendPort + "/assets/site.css"
+
+	b.ReportAllocs()
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			if w.Code != http.StatusOK {
+				b.Errorf("status %d", w.Code)
+				return
+			}
+			perRequest()
+		}
+	})
+	b.ReportMetric(float64(atomic.LoadInt64(conns))/float64(b.N), "upstream-conns/op")
+}
+
+// BenchmarkProxyAssetPage measures the registry-backed proxy
+func BenchmarkProxyAssetPage(b *testing.B) {
+	p := NewProxy(0, false, false)
+	p.ownerCheck = false
+	benchmarkAssetPage(b, p, func() {})
+}
+
+// BenchmarkProxyAssetPageUncached approximates the previous behaviour: a
+// new ReverseProxy per request on a DefaultTransport-style pool
+func BenchmarkProxyAssetPageUncached(b *testing.B) {
+	p := NewProxy(0, false, false)
+	p.ownerCheck = false
+	p.transport = http.DefaultTransport.(*http.Transport).Clone()
+	benchmarkAssetPage(b, p, func() { p.registry.sweep(nil, 0) })
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Registry tuning
+const (
+	// registryMaxIdle evicts proxies that have not served a request recently
+	registryMaxIdle = 10 * time.Minute
+	// registrySweepInterval is how often idle and dead targets are evicted
+	registrySweepInterval = time.Minute
+)
+
+// upstreamTarget describes where a routed request is forwarded. It is the
+// registry key: requests to the same target share one cached ReverseProxy.
+type upstreamTarget struct {
+	host       string // host of the upstream URL, e.g. 127.0.0.1:5500
+	port       int    // TCP port, used to evict when it stops listening (0 for sockets)
+	socketPath string // dial this Unix socket instead of host
+	tls        bool   // speak HTTPS to the upstream
+}
+
+// name describes the target in logs and error messages
+func (t upstreamTarget) name() string {
+	if t.socketPath != "" {
+		return "socket " + filepath.Base(t.socketPath)
+	}
+	if t.tls {
+		return fmt.Sprintf("port %d (https://%s)", t.port, t.host)
+	}
+	return fmt.Sprintf("port %d (%s)", t.port, t.host)
+}
+
+// routeContext carries per-request routing decisions into the cached
+// ReverseProxy, whose Director and ModifyResponse are shared by all
+// requests to a target
+type routeContext struct {
+	prefix         string       // route prefix as the browser sees it, e.g. /port/5500
+	port           int          // target TCP port (0 for sockets)
+	path           string       // upstream path, normally with the prefix removed
+	preserve       bool         // path keeps the prefix (/absport), so none is stripped
+	originalPath   string       // full path as the browser sees it, used for the <base> tag
+	rewrite        bool         // rewrite HTML bodies and Location headers
+	location       bool         // rewrite Location headers only
+	shim           bool         // inject the client-side URL shim into HTML
+	acceptEncoding string       // client's, before narrowing for the upstream
+	hostRewrite    bool         // send the upstream address as Host
+	origin         originPolicy // Origin and Referer handling
+	h2c            bool         // speak HTTP/2 cleartext to the upstream
+}
+
+type routeContextKey struct{}
+
+// routeFrom returns the routeContext attached by forward
+func routeFrom(ctx context.Context) routeContext {
+	route, _ := ctx.Value(routeContextKey{}).(routeContext)
+	return route
+}
+
+// newUpstreamTransport returns the transport shared by all TCP upstreams.
+// Asset-heavy pages (pkgdown, Quarto, MultiQC) fire dozens of parallel
+// requests at one port, so idle connections per host are raised well above
+// the DefaultTransport's 2. Environment proxies are ignored: on HPC nodes
+// http_proxy is often set and must never apply to node-local services.
+func newUpstreamTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          256,
+		MaxIdleConnsPerHost:   32,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// newSocketTransport returns a transport that dials the Unix socket at path
+func newSocketTransport(path string) *http.Transport {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	return &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", path)
+		},
+		MaxIdleConns:        32,
+		MaxIdleConnsPerHost: 32,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+// proxyEntry is a cached ReverseProxy for one upstream target
+type proxyEntry struct {
+	proxy    *httputil.ReverseProxy
+	port     int
+	close    func() // releases per-target resources (socket transports)
+	lastUsed time.Time
+}
+
+// proxyRegistry caches one ReverseProxy per upstream target
+type proxyRegistry struct {
+	mu      sync.Mutex
+	entries map[upstreamTarget]*proxyEntry
+}
+
+func newProxyRegistry() *proxyRegistry {
+	return &proxyRegistry{entries: make(map[upstreamTarget]*proxyEntry)}
+}
+
+// get returns the cached proxy for key, calling build on a miss
+func (reg *proxyRegistry) get(key upstreamTarget, build func(upstreamTarget) *proxyEntry) *httputil.ReverseProxy {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	entry, ok := reg.entries[key]
+	if !ok {
+		entry = build(key)
+		reg.entries[key] = entry
+	}
+	entry.lastUsed = time.Now()
+	return entry.proxy
+}
+
+// evict drops the cached proxy for key
+func (reg *proxyRegistry) evict(key upstreamTarget) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if entry, ok := reg.entries[key]; ok {
+		if entry.close != nil {
+			entry.close()
+		}
+		delete(reg.entries, key)
+	}
+}
+
+// sweep evicts entries idle for longer than maxIdle and, when listening is
+// non-nil, TCP entries whose port is no longer in the listening set
+func (reg *proxyRegistry) sweep(listening map[int]bool, maxIdle time.Duration) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	now := time.Now()
+	for key, entry := range reg.entries {
+		idle := now.Sub(entry.lastUsed) > maxIdle
+		dead := listening != nil && entry.port != 0 && !listening[entry.port]
+		if idle || dead {
+			if entry.close != nil {
+				entry.close()
+			}
+			delete(reg.entries, key)
+		}
+	}
+}
+
+// len reports the number of cached proxies
+func (reg *proxyRegistry) len() int {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return len(reg.entries)
+}
+
+// sweepRegistry periodically evicts idle proxies and those for ports that
+// stopped listening, until stop is closed
+func (p *Proxy) sweepRegistry(stop <-chan struct{}) {
+	ticker := time.NewTicker(registrySweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.sweepOnce()
+		}
+	}
+}
+
+// sweepOnce runs one pass of sweepRegistry. Evicted socket and HTTPS
+// entries close their own transports; idle connections on the shared
+// transports are left to IdleConnTimeout, since closing them would drop
+// the pooled connections to every live upstream too.
+func (p *Proxy) sweepOnce() {
+	var listening map[int]bool
+	if sockets, err := p.procfs.listeningSockets(); err == nil {
+		listening = make(map[int]bool, len(sockets))
+		for _, s := range sockets {
+			listening[s.Port] = true
+		}
+	}
+	p.registry.sweep(listening, registryMaxIdle)
+	if listening != nil {
+		p.certPins.retain(listening)
+	}
+}
+
+// newProxyEntry builds the ReverseProxy for a target. Per-request state
+// (paths, rewrite policy) comes from the routeContext on each request.
+func (p *Proxy) newProxyEntry(target upstreamTarget) *proxyEntry {
+	scheme := "http"
+	if target.tls {
+		scheme = "https"
+	}
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{
+		Scheme: scheme,
+		Host:   target.host,
+	})
+	entry := &proxyEntry{proxy: proxy, port: target.port}
+
+	if target.socketPath != "" {
+		transport := newSocketTransport(target.socketPath)
+		proxy.Transport = transport
+		entry.close = transport.CloseIdleConnections
+	} else if target.tls {
+		transport := p.newTLSTransport(target.port)
+		proxy.Transport = transport
+		entry.close = transport.CloseIdleConnections
+	} else {
+		proxy.Transport = &upstreamRoundTripper{http1: p.transport, h2c: p.h2cTransport}
+	}
+
+	// Customize director to rewrite path
+	originalDirector := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		route := routeFrom(req.Context())
+		// The outgoing request still carries the incoming URL and Host
+		originalHost := req.Host
+		originalDirector(req)
+		req.URL.Path = route.path
+		req.URL.RawPath = route.path
+		setForwardedHeaders(req, route, originalHost)
+		setUpstreamIdentity(req, route, target.host)
+		if route.rewrite || route.shim {
+			// Only ask for encodings the body rewriter can decode
+			if accept := decodableAcceptEncoding(req.Header.Get("Accept-Encoding")); accept != "" {
+				req.Header.Set("Accept-Encoding", accept)
+			} else {
+				req.Header.Del("Accept-Encoding")
+			}
+		}
+		if p.cookieNamespace {
+			stripCookieNamespace(req, cookieNamespace(route.prefix))
+		}
+	}
+
+	// Optionally modify response for redirect and HTML rewriting
+	// Pass the original path so base tag can be set correctly for subdirectories
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		route := routeFrom(resp.Request.Context())
+		if err := detectTLSUpstream(resp); err != nil {
+			return err
+		}
+		if err := p.rewritePrefixed(resp, route); err != nil {
+			return &rewriteError{Err: err}
+		}
+		p.compressResponse(resp, route.acceptEncoding)
+		return nil
+	}
+
+	// Handle errors
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		// A client going away says nothing about the upstream
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		log.Printf("Proxy error to %s: %v", target.name(), err)
+		var rerr *rewriteError
+		if !errors.As(err, &rerr) {
+			p.registry.evict(target)
+		}
+		if target.port != 0 && rerr == nil {
+			// The service may have restarted on a different address
+			p.upstreams.forget(target.port)
+			if isNotListening(err) && isNavigation(r) && p.startupWait > 0 {
+				// Restarting, most likely: wait for it like a fresh start
+				p.serveStarting(w, target.port)
+				return
+			}
+		}
+		p.serveFailure(w, r, p.diagnose(target, err))
+	}
+
+	return entry
+}
+
+// forward proxies HTTP and WebSocket requests through the cached
+// ReverseProxy for target
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request, target upstreamTarget, route routeContext) {
+	proxy := p.registry.get(target, p.newProxyEntry)
+	route.originalPath = p.externalPrefix + r.URL.Path
+	route.acceptEncoding = r.Header.Get("Accept-Encoding")
+	r = r.WithContext(context.WithValue(r.Context(), routeContextKey{}, route))
+	proxy.ServeHTTP(w, r)
+}
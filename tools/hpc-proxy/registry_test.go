@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRegistryReusesProxyPerTarget(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer backend.Close()
+	backendPort := strconv.Itoa(backend.Listener.Addr().(*net.TCPAddr).Port)
+
+	p := NewProxy(0, false, false)
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		req := httptest.NewRequest("GET", "/port/"+backendPort+path, nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		// Per-request paths must not leak between requests sharing a proxy
+		if w.Body.String() != path {
+			t.Errorf("upstream saw %q, want %q", w.Body.String(), path)
+		}
+	}
+
+	if n := p.registry.len(); n != 1 {
+		t.Errorf("expected 1 cached proxy, got %d", n)
+	}
+}
+
+func TestRegistryEvictsOnError(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backendPort := strconv.Itoa(backend.Listener.Addr().(*net.TCPAddr).Port)
+
+	p := NewProxy(0, false, false)
+
+	req := httptest.NewRequest("GET", "/port/"+backendPort+"/", nil)
+	p.ServeHTTP(httptest.NewRecorder(), req)
+	if n := p.registry.len(); n != 1 {
+		t.Fatalf("expected 1 cached proxy, got %d", n)
+	}
+
+	// Upstream goes away while its address is still remembered
+	backend.Close()
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected status 502, got %d", w.Code)
+	}
+	if n := p.registry.len(); n != 0 {
+		t.Errorf("expected failed target to be evicted, %d cached", n)
+	}
+}
+
+func TestRegistrySweep(t *testing.T) {
+	reg := newProxyRegistry()
+	closed := map[string]bool{}
+	add := func(target upstreamTarget) {
+		reg.get(target, func(target upstreamTarget) *proxyEntry {
+			return &proxyEntry{port: target.port, close: func() { closed[target.name()] = true }}
+		})
+	}
+	add(upstreamTarget{host: "127.0.0.1:5500", port: 5500})
+	add(upstreamTarget{host: "127.0.0.1:3838", port: 3838})
+	add(upstreamTarget{host: "localhost", socketPath: "/tmp/app"})
+
+	// 3838 stopped listening; sockets are not tracked by port
+	reg.sweep(map[int]bool{5500: true}, time.Hour)
+	if reg.len() != 2 || !closed["port 3838 (127.0.0.1:3838)"] {
+		t.Errorf("expected dead port to be evicted, %d left, closed=%v", reg.len(), closed)
+	}
+
+	// Unknown listening set (procfs unreadable) only evicts idle entries
+	reg.sweep(nil, time.Hour)
+	if reg.len() != 2 {
+		t.Errorf("expected no eviction without idle entries, %d left", reg.len())
+	}
+
+	reg.sweep(nil, 0)
+	if reg.len() != 0 || !closed["socket app"] {
+		t.Errorf("expected idle entries to be evicted and closed, %d left", reg.len())
+	}
+}
+
+func TestRegistrySweepKeepsPooledConnections(t *testing.T) {
+	var conns atomic.Int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+	backendPort := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	p := NewProxy(0, false, false)
+	p.ownerCheck = false
+	tcp := fmt.Sprintf("   0: 0100007F:%04X 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 1001 1 0000000000000000 100 0 0 10 0\n", backendPort)
+	p.procfs = procFS{root: writeFakeProc(t, tcp, "")}
+
+	get := func() {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "/port/"+strconv.Itoa(backendPort)+"/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+	}
+	get()
+	// The resolver's reachability check dials too
+	before := conns.Load()
+
+	// A port that stopped listening is evicted...
+	p.registry.get(upstreamTarget{host: "127.0.0.1:1", port: 1}, p.newProxyEntry)
+	p.sweepOnce()
+	if n := p.registry.len(); n != 1 {
+		t.Fatalf("expected only the dead port to be evicted, %d cached", n)
+	}
+
+	// ...without dropping the pooled connection to the live one
+	get()
+	if n := conns.Load() - before; n != 0 {
+		t.Errorf("expected the keep-alive connection to be reused, backend saw %d new connections", n)
+	}
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// headHoldLimit caps how much of <head> is held back while looking for an
+// existing <base> tag. Past it the base tag is injected regardless.
+const headHoldLimit = 64 << 10
+
+// urlGrammar is how URLs are laid out in an attribute value
+type urlGrammar int
+
+const (
+	urlSingle  urlGrammar = iota // the whole value is one URL
+	urlList                      // space-separated URLs (ping, archive)
+	urlSrcset                    // comma-separated image candidates with descriptors
+	urlRefresh                   // "5; url=/next" in <meta http-equiv="refresh">
+	urlCSS                       // url() references in a style attribute
+)
+
+// urlAttr describes a URL-bearing attribute. Attributes that only carry
+// URLs on some elements list them; the rest apply to every element.
+type urlAttr struct {
+	grammar  urlGrammar
+	elements []string
+}
+
+// urlAttrs are the attributes whose values are rewritten, covering the
+// URL attributes of HTML and SVG
+var urlAttrs = map[string]urlAttr{
+	"href":        {grammar: urlSingle}, // a, area, link, base, SVG 2 elements
+	"xlink:href":  {grammar: urlSingle}, // SVG 1.1 use, image, a, ...
+	"src":         {grammar: urlSingle},
+	"action":      {grammar: urlSingle, elements: []string{"form"}},
+	"formaction":  {grammar: urlSingle, elements: []string{"button", "input"}},
+	"poster":      {grammar: urlSingle, elements: []string{"video"}},
+	"data":        {grammar: urlSingle, elements: []string{"object"}},
+	"cite":        {grammar: urlSingle, elements: []string{"blockquote", "q", "del", "ins"}},
+	"background":  {grammar: urlSingle, elements: []string{"body", "table", "td", "th"}},
+	"longdesc":    {grammar: urlSingle, elements: []string{"img", "frame", "iframe"}},
+	"manifest":    {grammar: urlSingle, elements: []string{"html"}},
+	"codebase":    {grammar: urlSingle, elements: []string{"object", "applet"}},
+	"icon":        {grammar: urlSingle, elements: []string{"command", "menuitem"}},
+	"ping":        {grammar: urlList, elements: []string{"a", "area"}},
+	"archive":     {grammar: urlList, elements: []string{"object", "applet"}},
+	"srcset":      {grammar: urlSrcset, elements: []string{"img", "source"}},
+	"imagesrcset": {grammar: urlSrcset, elements: []string{"link"}},
+	"content":     {grammar: urlRefresh, elements: []string{"meta"}},
+	"style":       {grammar: urlCSS},
+}
+
+// appliesTo reports whether the attribute carries a URL on element
+func (a urlAttr) appliesTo(element string) bool {
+	if a.elements == nil {
+		return true
+	}
+	for _, e := range a.elements {
+		if e == element {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshPattern splits a refresh value into the delay and separator, and
+// the URL. The "url=" label and quotes are optional.
+var refreshPattern = regexp.MustCompile(`(?i)^(\s*[\d.]*\s*[;,]?\s*(?:url\s*=\s*)?['"]?)(.*)$`)
+
+// headElements may appear in <head>; any other start tag begins the body
+var headElements = map[string]bool{
+	"base":     true,
+	"link":     true,
+	"meta":     true,
+	"noscript": true,
+	"script":   true,
+	"style":    true,
+	"template": true,
+	"title":    true,
+}
+
+// rawTextElements are the elements whose content the tokenizer returns as
+// a single text token. Their content is streamed past the tokenizer
+// instead, so a multi-megabyte inline script is never held whole.
+var rawTextElements = map[string]bool{
+	"iframe":    true,
+	"noembed":   true,
+	"noframes":  true,
+	"noscript":  true,
+	"plaintext": true,
+	"script":    true,
+	"style":     true,
+	"textarea":  true,
+	"title":     true,
+	"xmp":       true,
+}
+
+// Where the rewriter is relative to the document head
+const (
+	beforeHead = iota // doctype, comments, <html>
+	inHead            // holding tokens until a <base> is found or ruled out
+	afterHead         // injection decided; everything streams through
+)
+
+// htmlEdits selects what an htmlRewriter changes in a page
+type htmlEdits struct {
+	prefix   string // route prefix, e.g. /port/5500
+	urls     bool   // prefix root-relative URLs in attributes and stylesheets
+	basePath string // inject <base href>, unless empty or the page has its own
+	shim     bool   // inject the client-side URL shim
+}
+
+// htmlRewriter streams an HTML document, prefixing root-relative URLs in
+// URL-bearing attributes and <style> blocks, and injecting a <base> tag
+// and the shim at the start of the head. Only tags and stylesheets are
+// touched: text, comments and script bodies pass through byte for byte,
+// as does everything in a tag but the rewritten attribute values.
+type htmlRewriter struct {
+	z       *html.Tokenizer
+	src     io.Reader // input the tokenizer reads from
+	body    io.Closer
+	prefix  string
+	urls    bool
+	baseTag string // empty once injected, or when the page has its own
+	shimTag string // injected with the base tag, before any page script
+
+	state   int
+	rawText *rawTextReader // content of the raw text element being read
+	rawOut  io.Reader      // rawText, through the CSS rewriter for <style>
+	buf     []byte
+	held    bytes.Buffer // head tokens after the injection point
+	out     bytes.Buffer
+	err     error
+}
+
+// newHTMLRewriter rewrites the HTML read from r. body is closed with the
+// rewriter.
+func newHTMLRewriter(r io.Reader, body io.Closer, edits htmlEdits) *htmlRewriter {
+	rw := &htmlRewriter{
+		z:      html.NewTokenizer(r),
+		src:    r,
+		body:   body,
+		prefix: edits.prefix,
+		urls:   edits.urls,
+		state:  beforeHead,
+	}
+	if edits.basePath != "" {
+		// HTML-escape basePath to prevent XSS via crafted URLs
+		rw.baseTag = `<base href="` + html.EscapeString(edits.basePath) + `">`
+	}
+	if edits.shim {
+		rw.shimTag = shimTag(edits.prefix)
+	}
+	if rw.baseTag == "" && rw.shimTag == "" {
+		rw.state = afterHead
+	}
+	return rw
+}
+
+func (rw *htmlRewriter) Read(p []byte) (int, error) {
+	for rw.out.Len() == 0 && rw.err == nil {
+		rw.next()
+	}
+	if rw.out.Len() > 0 {
+		return rw.out.Read(p)
+	}
+	return 0, rw.err
+}
+
+func (rw *htmlRewriter) Close() error {
+	return rw.body.Close()
+}
+
+// next processes one token, or one chunk of raw text, into the output
+func (rw *htmlRewriter) next() {
+	if rw.rawText != nil {
+		rw.nextRawText()
+		return
+	}
+
+	tt := rw.z.Next()
+	if tt == html.ErrorToken {
+		// Anything left is an unterminated tag or text; pass it through
+		rw.emit(rw.z.Raw())
+		rw.endHead()
+		rw.err = rw.z.Err()
+		return
+	}
+
+	// Tags are read from the raw bytes: the tokenizer's TagName lower-cases
+	// them in place, which would alter the output
+	raw := rw.z.Raw()
+	var name string
+	switch tt {
+	case html.StartTagToken, html.SelfClosingTagToken:
+		name = rawTagName(raw[1:])
+		if rw.urls {
+			raw = rw.rewriteTag(raw, name)
+		}
+		if rawTextElements[name] {
+			// Once the tag is written; like the tokenizer, <script/>
+			// counts as a start tag
+			defer rw.startRawText(name)
+		}
+	case html.EndTagToken:
+		name = rawTagName(raw[2:])
+	}
+
+	switch rw.state {
+	case beforeHead:
+		switch {
+		case tt == html.StartTagToken && name == "head":
+			rw.out.Write(raw)
+			rw.state = inHead
+			return
+		case tt == html.DoctypeToken, tt == html.CommentToken, isBlank(tt, raw),
+			tt == html.StartTagToken && name == "html":
+			rw.out.Write(raw)
+			return
+		case (tt == html.StartTagToken || tt == html.SelfClosingTagToken) && headElements[name]:
+			// The head is implied; it starts here
+			rw.state = inHead
+		default:
+			// No head at all: inject before the first content
+			rw.endHead()
+			rw.out.Write(raw)
+			return
+		}
+	case afterHead:
+		rw.out.Write(raw)
+		return
+	}
+
+	// inHead
+	if name == "base" && tt != html.EndTagToken && hasAttr(raw, "href") {
+		// The page sets its own base; keep it and inject ours no more
+		rw.baseTag = ""
+		rw.held.Write(raw)
+		rw.endHead()
+		return
+	}
+	if rw.endsHead(tt, name, raw) {
+		rw.endHead()
+		rw.out.Write(raw)
+		return
+	}
+	rw.held.Write(raw)
+	if rw.held.Len() > headHoldLimit {
+		rw.endHead()
+	}
+}
+
+// startRawText switches from the tokenizer to streaming the content of
+// the raw text element that was just opened
+func (rw *htmlRewriter) startRawText(name string) {
+	// What the tokenizer read ahead comes first
+	src := io.MultiReader(bytes.NewReader(rw.z.Buffered()), rw.src)
+	rw.rawText = newRawTextReader(src, name)
+	rw.rawOut = rw.rawText
+	if rw.urls && name == "style" {
+		rw.rawOut = newCSSRewriter(rw.rawText, io.NopCloser(nil), rw.prefix)
+	}
+	if rw.buf == nil {
+		rw.buf = make([]byte, 32<<10)
+	}
+}
+
+// nextRawText passes on the next chunk of raw text. At the end tag a
+// fresh tokenizer takes over from it.
+func (rw *htmlRewriter) nextRawText() {
+	n, err := rw.rawOut.Read(rw.buf)
+	rw.emit(rw.buf[:n])
+	if rw.state == inHead && rw.held.Len() > headHoldLimit {
+		rw.endHead()
+	}
+	if err == nil {
+		return
+	}
+	rest := rw.rawText.rest
+	rw.rawText, rw.rawOut = nil, nil
+	if err == io.EOF && rest != nil {
+		rw.src = rest
+		rw.z = html.NewTokenizer(rest)
+		return
+	}
+	// The document ended inside the element
+	rw.endHead()
+	rw.err = err
+}
+
+// endsHead reports whether a token in the head closes it
+func (rw *htmlRewriter) endsHead(tt html.TokenType, name string, raw []byte) bool {
+	switch tt {
+	case html.EndTagToken:
+		return name == "head"
+	case html.StartTagToken, html.SelfClosingTagToken:
+		return !headElements[name]
+	case html.TextToken:
+		// Text inside <script>, <style> and <title> never gets here
+		return !isBlank(tt, raw)
+	}
+	return false
+}
+
+// endHead injects the base tag, if still wanted, and the shim, followed
+// by the held head tokens
+func (rw *htmlRewriter) endHead() {
+	if rw.state == afterHead {
+		return
+	}
+	rw.state = afterHead
+	rw.out.WriteString(rw.baseTag)
+	rw.out.WriteString(rw.shimTag)
+	rw.baseTag = ""
+	rw.shimTag = ""
+	rw.out.Write(rw.held.Bytes())
+	rw.held.Reset()
+}
+
+// emit writes raw to wherever the current state sends output
+func (rw *htmlRewriter) emit(raw []byte) {
+	if rw.state == inHead {
+		rw.held.Write(raw)
+	} else {
+		rw.out.Write(raw)
+	}
+}
+
+// rawTextReader reads the content of a raw text element such as <script>
+// up to its end tag, which it leaves unread for the tokenizer. Script
+// escapes (<!--<script>...</script>-->) are not tracked; the first
+// matching end tag closes the element.
+type rawTextReader struct {
+	r       io.Reader
+	endTag  []byte // "</script", or nil for <plaintext>, which never ends
+	buf     []byte
+	pending []byte
+	ready   int       // pending bytes known to precede the end tag
+	rest    io.Reader // input from the end tag on, once found
+	err     error
+}
+
+func newRawTextReader(r io.Reader, element string) *rawTextReader {
+	rr := &rawTextReader{r: r, buf: make([]byte, 32<<10)}
+	if element != "plaintext" {
+		rr.endTag = []byte("</" + element)
+	}
+	return rr
+}
+
+func (rr *rawTextReader) Read(p []byte) (int, error) {
+	for rr.ready == 0 && rr.err == nil {
+		rr.fill()
+	}
+	if rr.ready > 0 {
+		n := copy(p, rr.pending[:rr.ready])
+		rr.pending = rr.pending[n:]
+		rr.ready -= n
+		return n, nil
+	}
+	return 0, rr.err
+}
+
+// fill reads the next chunk and marks everything before a possible end
+// tag as ready
+func (rr *rawTextReader) fill() {
+	n, err := rr.r.Read(rr.buf)
+	rr.pending = append(rr.pending, rr.buf[:n]...)
+	if rr.scan() {
+		return
+	}
+	if err != nil {
+		// No end tag is coming; pass the rest through
+		rr.ready = len(rr.pending)
+		rr.err = err
+	}
+}
+
+// scan looks for the end tag in what is pending, reporting whether it was
+// found
+func (rr *rawTextReader) scan() bool {
+	if rr.endTag == nil {
+		rr.ready = len(rr.pending)
+		return false
+	}
+	for i := 0; ; i += 2 {
+		j := bytes.Index(rr.pending[i:], []byte("</"))
+		if j < 0 {
+			// A trailing '<' may begin the end tag
+			rr.ready = len(rr.pending)
+			if rr.ready > 0 && rr.pending[rr.ready-1] == '<' {
+				rr.ready--
+			}
+			return false
+		}
+		i += j
+		tag := rr.pending[i:]
+		if len(tag) <= len(rr.endTag) {
+			// Too short to tell yet
+			rr.ready = i
+			return false
+		}
+		if bytes.EqualFold(tag[:len(rr.endTag)], rr.endTag) && isTagEnd(tag[len(rr.endTag)]) {
+			rr.ready = i
+			rr.rest = io.MultiReader(bytes.NewReader(tag), rr.r)
+			rr.err = io.EOF
+			return true
+		}
+	}
+}
+
+// rewriteTag prefixes root-relative URLs in the URL attributes of a raw
+// start tag, leaving quoting and everything else as written
+func (rw *htmlRewriter) rewriteTag(raw []byte, element string) []byte {
+	attrs := tagAttrs(raw)
+	var rewritten []byte
+	last := 0
+	for _, a := range attrs {
+		spec, ok := urlAttrs[a.name]
+		if a.valStart < 0 || !ok || !spec.appliesTo(element) {
+			continue
+		}
+		if spec.grammar == urlRefresh && !isRefresh(raw, attrs) {
+			continue
+		}
+		value := string(raw[a.valStart:a.valEnd])
+		newValue, ok := rw.rewriteValue(value, spec.grammar)
+		if !ok {
+			continue
+		}
+		rewritten = append(rewritten, raw[last:a.valStart]...)
+		rewritten = append(rewritten, newValue...)
+		last = a.valEnd
+	}
+	if rewritten == nil {
+		return raw
+	}
+	return append(rewritten, raw[last:]...)
+}
+
+// rewriteValue rewrites the URLs in an attribute value according to its
+// grammar, reporting whether anything changed
+func (rw *htmlRewriter) rewriteValue(value string, grammar urlGrammar) (string, bool) {
+	switch grammar {
+	case urlList:
+		return rw.rewriteList(value)
+	case urlSrcset:
+		return rw.rewriteSrcset(value)
+	case urlRefresh:
+		m := refreshPattern.FindStringSubmatch(value)
+		if m == nil {
+			return value, false
+		}
+		target, ok := rw.rewriteURL(m[2])
+		return m[1] + target, ok
+	case urlCSS:
+		return rewriteCSS(value, rw.prefix)
+	}
+	return rw.rewriteURL(value)
+}
+
+// rewriteList rewrites each URL in a space-separated list
+func (rw *htmlRewriter) rewriteList(value string) (string, bool) {
+	var b strings.Builder
+	changed := false
+	i := 0
+	for i < len(value) {
+		j := i
+		for j < len(value) && isSpace(value[j]) {
+			j++
+		}
+		b.WriteString(value[i:j])
+		i = j
+		for j < len(value) && !isSpace(value[j]) {
+			j++
+		}
+		u, ok := rw.rewriteURL(value[i:j])
+		b.WriteString(u)
+		changed = changed || ok
+		i = j
+	}
+	return b.String(), changed
+}
+
+// rewriteSrcset rewrites the URL of each image candidate in a srcset,
+// following the HTML parsing rules: candidates are separated by commas,
+// and a URL runs to the next whitespace, less any trailing commas
+func (rw *htmlRewriter) rewriteSrcset(value string) (string, bool) {
+	var b strings.Builder
+	changed := false
+	i := 0
+	for i < len(value) {
+		// Separators before the candidate
+		j := i
+		for j < len(value) && (isSpace(value[j]) || value[j] == ',') {
+			j++
+		}
+		b.WriteString(value[i:j])
+		i = j
+		if i >= len(value) {
+			break
+		}
+
+		// The URL
+		for j < len(value) && !isSpace(value[j]) {
+			j++
+		}
+		candidate := value[i:j]
+		url := strings.TrimRight(candidate, ",")
+		u, ok := rw.rewriteURL(url)
+		b.WriteString(u)
+		b.WriteString(candidate[len(url):])
+		changed = changed || ok
+		i = j
+		if len(url) < len(candidate) {
+			// Trailing commas ended the candidate
+			continue
+		}
+
+		// Descriptors up to the next comma outside parentheses
+		depth := 0
+		for j < len(value) && (value[j] != ',' || depth > 0) {
+			switch value[j] {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			}
+			j++
+		}
+		b.WriteString(value[i:j])
+		i = j
+	}
+	return b.String(), changed
+}
+
+// isRefresh reports whether a raw <meta> tag is http-equiv="refresh"
+func isRefresh(raw []byte, attrs []rawAttr) bool {
+	for _, a := range attrs {
+		if a.name == "http-equiv" && a.valStart >= 0 {
+			return strings.EqualFold(strings.TrimSpace(string(raw[a.valStart:a.valEnd])), "refresh")
+		}
+	}
+	return false
+}
+
+// rewriteURL prefixes a root-relative URL
+func (rw *htmlRewriter) rewriteURL(value string) (string, bool) {
+	return prefixURL(value, rw.prefix)
+}
+
+// prefixURL prefixes a root-relative URL. Protocol-relative and
+// already-routed URLs are left alone.
+func prefixURL(value, prefix string) (string, bool) {
+	if !strings.HasPrefix(value, "/") || strings.HasPrefix(value, "//") || isRoutedPath(value, prefix) {
+		return value, false
+	}
+	return prefix + value, true
+}
+
+// rawTagName returns the lower-cased tag name at the start of b
+func rawTagName(b []byte) string {
+	i := 0
+	for i < len(b) && !isSpace(b[i]) && b[i] != '/' && b[i] != '>' {
+		i++
+	}
+	return strings.ToLower(string(b[:i]))
+}
+
+// rawAttr locates one attribute in a raw tag. valStart is -1 for an
+// attribute without a value.
+type rawAttr struct {
+	name             string
+	valStart, valEnd int
+}
+
+// tagAttrs scans the attributes of a raw start tag following the HTML
+// attribute syntax, so unquoted and single-quoted values are found too
+func tagAttrs(raw []byte) []rawAttr {
+	var attrs []rawAttr
+	n := len(raw)
+	i := 1 // skip '<'
+	for i < n && !isSpace(raw[i]) && raw[i] != '/' && raw[i] != '>' {
+		i++
+	}
+	for {
+		for i < n && (isSpace(raw[i]) || raw[i] == '/') {
+			i++
+		}
+		if i >= n || raw[i] == '>' {
+			return attrs
+		}
+
+		nameStart := i
+		i++ // a leading '=' is part of the name
+		for i < n && !isSpace(raw[i]) && raw[i] != '/' && raw[i] != '>' && raw[i] != '=' {
+			i++
+		}
+		attr := rawAttr{name: strings.ToLower(string(raw[nameStart:i])), valStart: -1}
+
+		j := i
+		for j < n && isSpace(raw[j]) {
+			j++
+		}
+		if j < n && raw[j] == '=' {
+			j++
+			for j < n && isSpace(raw[j]) {
+				j++
+			}
+			if j < n && (raw[j] == '"' || raw[j] == '\'') {
+				quote := raw[j]
+				attr.valStart = j + 1
+				end := bytes.IndexByte(raw[attr.valStart:], quote)
+				if end < 0 {
+					return attrs
+				}
+				attr.valEnd = attr.valStart + end
+				i = attr.valEnd + 1
+			} else {
+				attr.valStart = j
+				for j < n && !isSpace(raw[j]) && raw[j] != '>' {
+					j++
+				}
+				attr.valEnd = j
+				i = j
+			}
+		}
+		attrs = append(attrs, attr)
+	}
+}
+
+// hasAttr reports whether a raw tag has an attribute called name
+func hasAttr(raw []byte, name string) bool {
+	for _, a := range tagAttrs(raw) {
+		if a.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isBlank reports whether a token is whitespace-only text
+func isBlank(tt html.TokenType, raw []byte) bool {
+	return tt == html.TextToken && len(bytes.TrimSpace(raw)) == 0
+}
+
+// isTagEnd reports whether c ends a tag name
+func isTagEnd(c byte) bool {
+	return isSpace(c) || c == '/' || c == '>'
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// rewriteHTMLString runs input through the streaming HTML rewriter
+func rewriteHTMLString(t *testing.T, input, prefix, basePath string) string {
+	t.Helper()
+	rw := newHTMLRewriter(strings.NewReader(input), io.NopCloser(nil), htmlEdits{prefix: prefix, urls: true, basePath: basePath})
+	out, err := io.ReadAll(rw)
+	if err != nil {
+		t.Fatalf("rewrite(%q) error = %v", input, err)
+	}
+	return string(out)
+}
+
+func TestRewriteHTMLBaseInjection(t *testing.T) {
+	const base = `<base href="/port/5500/">`
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "after head",
+			input: `<html><head><title>x</title></head><body></body></html>`,
+			want:  `<html><head>` + base + `<title>x</title></head><body></body></html>`,
+		},
+		{
+			name:  "head with attributes",
+			input: `<!DOCTYPE html><html lang="en"><head data-x="1"><meta charset="utf-8"></head>`,
+			want:  `<!DOCTYPE html><html lang="en"><head data-x="1">` + base + `<meta charset="utf-8"></head>`,
+		},
+		{
+			name:  "header element is not head",
+			input: `<!DOCTYPE html><html><header>x</header></html>`,
+			want:  `<!DOCTYPE html><html>` + base + `<header>x</header></html>`,
+		},
+		{
+			name:  "head inside comment ignored",
+			input: `<!-- <head> --><html><head></head></html>`,
+			want:  `<!-- <head> --><html><head>` + base + `</head></html>`,
+		},
+		{
+			name:  "implied head",
+			input: `<!DOCTYPE html><meta charset="utf-8"><title>x</title><p>hi`,
+			want:  `<!DOCTYPE html>` + base + `<meta charset="utf-8"><title>x</title><p>hi`,
+		},
+		{
+			name:  "fragment without head",
+			input: `<a href="/foo">link</a>`,
+			want:  base + `<a href="/port/5500/foo">link</a>`,
+		},
+		{
+			name:  "existing base in head kept",
+			input: `<html><head><meta charset="utf-8"><base href="/app/"></head></html>`,
+			want:  `<html><head><meta charset="utf-8"><base href="/port/5500/app/"></head></html>`,
+		},
+		{
+			name:  "base target without href",
+			input: `<html><head><base target="_blank"></head></html>`,
+			want:  `<html><head>` + base + `<base target="_blank"></head></html>`,
+		},
+		{
+			name:  "script in head does not end it",
+			input: `<html><head><script>document.write("<p>")</script><base href="./"></head></html>`,
+			want:  `<html><head><script>document.write("<p>")</script><base href="./"></head></html>`,
+		},
+		{
+			name:  "body content ends head",
+			input: `<html><head><title>x</title><body><base href="./">`,
+			want:  `<html><head>` + base + `<title>x</title><body><base href="./">`,
+		},
+		{
+			name:  "empty document",
+			input: ``,
+			want:  base,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rewriteHTMLString(t, tt.input, "/port/5500", "/port/5500/")
+			if got != tt.want {
+				t.Errorf("rewrite(%q)\n got %q\nwant %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteHTMLURLAttributes(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "srcset candidates",
+			input: `<img srcset="/a.png 1x, /b.png 2x">`,
+			want:  `<img srcset="/port/5500/a.png 1x, /port/5500/b.png 2x">`,
+		},
+		{
+			name:  "srcset without spaces after commas",
+			input: `<img srcset="/a.png 1x,/b.png 480w,https://cdn.example.com/c.png">`,
+			want:  `<img srcset="/port/5500/a.png 1x,/port/5500/b.png 480w,https://cdn.example.com/c.png">`,
+		},
+		{
+			name:  "srcset comma inside URL",
+			input: `<source srcset="/img/x,y.png 2x, /z.png,">`,
+			want:  `<source srcset="/port/5500/img/x,y.png 2x, /port/5500/z.png,">`,
+		},
+		{
+			name:  "link imagesrcset",
+			input: `<link rel="preload" as="image" imagesrcset="/hero.avif 1x">`,
+			want:  `<link rel="preload" as="image" imagesrcset="/port/5500/hero.avif 1x">`,
+		},
+		{
+			name:  "video poster",
+			input: `<video poster="/poster.jpg" src="/clip.mp4">`,
+			want:  `<video poster="/port/5500/poster.jpg" src="/port/5500/clip.mp4">`,
+		},
+		{
+			name:  "object data",
+			input: `<object data="/plot.svg" type="image/svg+xml">`,
+			want:  `<object data="/port/5500/plot.svg" type="image/svg+xml">`,
+		},
+		{
+			name:  "data on other elements untouched",
+			input: `<div data="/not-a-url">`,
+			want:  `<div data="/not-a-url">`,
+		},
+		{
+			name:  "button formaction",
+			input: `<button formaction="/save">`,
+			want:  `<button formaction="/port/5500/save">`,
+		},
+		{
+			name:  "svg xlink:href",
+			input: `<svg><use xlink:href="/sprite.svg#icon"/></svg>`,
+			want:  `<svg><use xlink:href="/port/5500/sprite.svg#icon"/></svg>`,
+		},
+		{
+			name:  "svg fragment href untouched",
+			input: `<svg><use href="#icon"/></svg>`,
+			want:  `<svg><use href="#icon"/></svg>`,
+		},
+		{
+			name:  "anchor ping list",
+			input: `<a href="/x" ping="/track /log">`,
+			want:  `<a href="/port/5500/x" ping="/port/5500/track /port/5500/log">`,
+		},
+		{
+			name:  "meta refresh",
+			input: `<meta http-equiv="refresh" content="0;url=/next">`,
+			want:  `<meta http-equiv="refresh" content="0;url=/port/5500/next">`,
+		},
+		{
+			name:  "meta refresh quoted URL",
+			input: `<meta http-equiv="Refresh" content="5; URL='/next'">`,
+			want:  `<meta http-equiv="Refresh" content="5; URL='/port/5500/next'">`,
+		},
+		{
+			name:  "meta refresh without URL",
+			input: `<meta http-equiv="refresh" content="30">`,
+			want:  `<meta http-equiv="refresh" content="30">`,
+		},
+		{
+			name:  "other meta content untouched",
+			input: `<meta name="x" content="/path">`,
+			want:  `<meta name="x" content="/path">`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rewriteHTMLString(t, tt.input, "/port/5500", "")
+			if got != tt.want {
+				t.Errorf("rewrite(%q)\n got %q\nwant %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteHTMLEscapesBasePath(t *testing.T) {
+	got := rewriteHTMLString(t, `<head></head>`, "/port/5500", `/port/5500/"><script>x</script>/`)
+	if strings.Contains(got, "<script>") {
+		t.Errorf("base path not escaped: %q", got)
+	}
+}
+
+func TestRewriteHTMLLargeHead(t *testing.T) {
+	// A head too large to hold back still gets its base tag, up front
+	script := "<script>" + strings.Repeat("x", headHoldLimit) + "</script>"
+	got := rewriteHTMLString(t, "<head>"+script+"<base href=\"./\"></head>", "/port/5500", "/port/5500/")
+	if !strings.HasPrefix(got, `<head><base href="/port/5500/">`+script) {
+		t.Errorf("expected base tag injected before the held head, got prefix %q", got[:60])
+	}
+}
+
+func TestRewriteHTMLStreams(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	rw := newHTMLRewriter(pr, pr, htmlEdits{prefix: "/port/5500", urls: true, basePath: "/port/5500/"})
+
+	go pw.Write([]byte(`<html><head></head><body><a href="/first">`))
+
+	// Output for the first chunk must arrive before the document ends
+	want := `<html><head><base href="/port/5500/"></head><body><a href="/port/5500/first">`
+	got := make(chan string, 1)
+	go func() {
+		buf := make([]byte, len(want))
+		n, _ := io.ReadFull(rw, buf)
+		got <- string(buf[:n])
+	}()
+
+	select {
+	case s := <-got:
+		if s != want {
+			t.Errorf("first chunk = %q, want %q", s, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("rewriter waited for the whole body")
+	}
+}
+
+func TestRewriteHTMLRawText(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "script markup untouched",
+			input: `<script>x = '<a href="/in-script">'</script><a href="/after">`,
+			want:  `<script>x = '<a href="/in-script">'</script><a href="/port/5500/after">`,
+		},
+		{
+			name:  "end tag in other case",
+			input: `<SCRIPT>1 < 2</Script ><a href="/after">`,
+			want:  `<SCRIPT>1 < 2</Script ><a href="/port/5500/after">`,
+		},
+		{
+			name:  "longer tag name does not close",
+			input: `<script>"</scripts>"; "<a href='/x'>"</script><img src="/y">`,
+			want:  `<script>"</scripts>"; "<a href='/x'>"</script><img src="/port/5500/y">`,
+		},
+		{
+			name:  "textarea content untouched",
+			input: `<textarea><img src="/x"></textarea><img src="/y">`,
+			want:  `<textarea><img src="/x"></textarea><img src="/port/5500/y">`,
+		},
+		{
+			name:  "style block rewritten",
+			input: `<style>a{background:url(/bg.png)}</style><img src="/y">`,
+			want:  `<style>a{background:url(/port/5500/bg.png)}</style><img src="/port/5500/y">`,
+		},
+		{
+			name:  "unterminated script",
+			input: `<script>x = "<a href='/x'>"`,
+			want:  `<script>x = "<a href='/x'>"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewriteHTMLString(t, tt.input, "/port/5500", ""); got != tt.want {
+				t.Errorf("rewrite(%q)\n got %q\nwant %q", tt.input, got, tt.want)
+			}
+
+			// End tags split across reads are still found
+			rw := newHTMLRewriter(iotest.OneByteReader(strings.NewReader(tt.input)), io.NopCloser(nil), htmlEdits{prefix: "/port/5500", urls: true})
+			got, err := io.ReadAll(rw)
+			if err != nil || string(got) != tt.want {
+				t.Errorf("rewrite(%q) one byte at a time\n got %q, %v\nwant %q", tt.input, got, err, tt.want)
+			}
+		})
+	}
+}
+
+// repeatReader yields b n times without holding it more than once
+type repeatReader struct {
+	b   []byte
+	n   int
+	off int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b[r.off:])
+	r.off += n
+	if r.off == len(r.b) {
+		r.off = 0
+		r.n--
+	}
+	return n, nil
+}
+
+// heapWriter keeps the tail of what is written, sampling the heap as it
+// goes
+type heapWriter struct {
+	written, sampled int
+	peak             uint64
+	tail             []byte
+}
+
+func (w *heapWriter) Write(p []byte) (int, error) {
+	w.written += len(p)
+	w.tail = append(w.tail, p...)
+	if len(w.tail) > 256 {
+		w.tail = append(w.tail[:0], w.tail[len(w.tail)-256:]...)
+	}
+	if w.written-w.sampled >= 1<<20 {
+		w.sampled = w.written
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		if m.HeapAlloc > w.peak {
+			w.peak = m.HeapAlloc
+		}
+	}
+	return len(p), nil
+}
+
+func TestRewriteHTMLLargeScriptBounded(t *testing.T) {
+	// A 64 MiB inline script, as in a self-contained htmlwidgets report
+	const chunks = 64 << 10
+	chunk := bytes.Repeat([]byte("x"), 1<<10)
+	input := io.MultiReader(
+		strings.NewReader(`<html><head><script>`),
+		&repeatReader{b: chunk, n: chunks},
+		strings.NewReader(`</script></head><body><a href="/after"></body></html>`),
+	)
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	rw := newHTMLRewriter(input, io.NopCloser(nil), htmlEdits{prefix: "/port/5500", urls: true, basePath: "/port/5500/"})
+	w := &heapWriter{}
+	if _, err := io.Copy(w, rw); err != nil {
+		t.Fatalf("rewrite error = %v", err)
+	}
+
+	if want := len(`<html><head><base href="/port/5500/"><script>`) + chunks<<10 + len(`</script></head><body><a href="/port/5500/after"></body></html>`); w.written != want {
+		t.Errorf("wrote %d bytes, want %d", w.written, want)
+	}
+	if !bytes.HasSuffix(w.tail, []byte(`<a href="/port/5500/after"></body></html>`)) {
+		t.Errorf("expected markup after the script to be rewritten, got tail %q", w.tail)
+	}
+	if grown := int64(w.peak) - int64(before.HeapAlloc); grown > 16<<20 {
+		t.Errorf("heap grew by %d MiB streaming a 64 MiB script", grown>>20)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//go:embed templates/shim.js
+var shimJS string
+
+// shimTag returns the inline script that installs the client-side URL shim
+// for prefix. It is inlined rather than linked so it runs before any page
+// script and needs no route of its own through the manager.
+func shimTag(prefix string) string {
+	// json.Marshal escapes <, > and &, so the prefix cannot end the script
+	arg, _ := json.Marshal(prefix)
+	return "<script>" + strings.TrimSpace(shimJS) + "(" + string(arg) + ");</script>"
+}
+
+// portSet is a set of ports, or every port, parsed from a flag like
+// "3838,8501" or "all"
+type portSet struct {
+	all   bool
+	ports map[int]bool
+}
+
+// parsePortSet parses a comma-separated list of ports, or "all"
+func parsePortSet(s string) (portSet, error) {
+	set := portSet{ports: make(map[int]bool)}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		switch field {
+		case "":
+			continue
+		case "all":
+			set.all = true
+			continue
+		}
+		port, err := strconv.Atoi(field)
+		if err != nil || port < 1 || port > 65535 {
+			return portSet{}, fmt.Errorf("invalid port %q", field)
+		}
+		set.ports[port] = true
+	}
+	return set, nil
+}
+
+// has reports whether port is in the set
+func (s portSet) has(port int) bool {
+	return s.all || s.ports[port]
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParsePortSet(t *testing.T) {
+	set, err := parsePortSet("3838, 8501,")
+	if err != nil {
+		t.Fatalf("parsePortSet() error = %v", err)
+	}
+	if !set.has(3838) || !set.has(8501) || set.has(5500) {
+		t.Errorf("parsePortSet(3838,8501) = %+v", set)
+	}
+
+	set, err = parsePortSet("all")
+	if err != nil || !set.has(5500) {
+		t.Errorf("parsePortSet(all) = %+v, %v", set, err)
+	}
+
+	if set, _ := parsePortSet(""); set.has(5500) {
+		t.Errorf("empty set has port 5500")
+	}
+	for _, bad := range []string{"abc", "0", "70000"} {
+		if _, err := parsePortSet(bad); err == nil {
+			t.Errorf("parsePortSet(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestShimTag(t *testing.T) {
+	tag := shimTag("/port/5500")
+	if !strings.HasPrefix(tag, "<script>") || !strings.HasSuffix(tag, `("/port/5500");</script>`) {
+		t.Errorf("shimTag() = %q..., want an inline script called with the prefix", tag[:40])
+	}
+	for _, api := range []string{"window.fetch", "XMLHttpRequest.prototype.open", `"WebSocket"`, `"EventSource"`, `"pushState"`} {
+		if !strings.Contains(tag, api) {
+			t.Errorf("shim does not patch %s", api)
+		}
+	}
+	if strings.Count(tag, "</script>") != 1 {
+		t.Errorf("shim closes its script element early")
+	}
+
+	// A prefix can never break out of the script element
+	if tag := shimTag("/socket/</script>"); strings.Count(tag, "</script>") != 1 {
+		t.Errorf("shimTag() did not escape the prefix: %q", tag[len(tag)-40:])
+	}
+}
+
+func TestRewriteHTMLShimInjection(t *testing.T) {
+	shim := shimTag("/port/5500")
+	tests := []struct {
+		name  string
+		edits htmlEdits
+		input string
+		want  string
+	}{
+		{
+			name:  "shim only, before page scripts",
+			edits: htmlEdits{prefix: "/port/5500", shim: true},
+			input: `<html><head><script src="/app.js"></script></head><body><a href="/x">x</a></body></html>`,
+			want:  `<html><head>` + shim + `<script src="/app.js"></script></head><body><a href="/x">x</a></body></html>`,
+		},
+		{
+			name:  "shim after base tag with URL rewriting",
+			edits: htmlEdits{prefix: "/port/5500", urls: true, basePath: "/port/5500/", shim: true},
+			input: `<html><head><script src="/app.js"></script></head></html>`,
+			want:  `<html><head><base href="/port/5500/">` + shim + `<script src="/port/5500/app.js"></script></head></html>`,
+		},
+		{
+			name:  "shim kept when page has its own base",
+			edits: htmlEdits{prefix: "/port/5500", urls: true, basePath: "/port/5500/", shim: true},
+			input: `<head><base href="/app/"><script></script></head>`,
+			want:  `<head>` + shim + `<base href="/port/5500/app/"><script></script></head>`,
+		},
+		{
+			name:  "no head",
+			edits: htmlEdits{prefix: "/port/5500", shim: true},
+			input: `<div>hi</div>`,
+			want:  shim + `<div>hi</div>`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := newHTMLRewriter(strings.NewReader(tt.input), io.NopCloser(nil), tt.edits)
+			out, err := io.ReadAll(rw)
+			if err != nil {
+				t.Fatalf("rewrite error = %v", err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("rewrite(%q)\n got: %s\nwant: %s", tt.input, out, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyServesShim(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><head><script src="/app.js"></script></head><body><a href="/x">x</a></body></html>`)
+	}))
+	defer backend.Close()
+	backendPort := strings.TrimPrefix(backend.URL, "http://127.0.0.1:")
+
+	get := func(p *Proxy) string {
+		req := httptest.NewRequest("GET", "/port/"+backendPort+"/", nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+
+	// Opted-in port without URL rewriting: only the shim is added
+	p := NewProxy(0, false, false)
+	p.ownerCheck = false
+	p.shim, _ = parsePortSet(backendPort)
+	body := get(p)
+	want := `<head>` + shimTag("/port/"+backendPort) + `<script src="/app.js">`
+	if !strings.Contains(body, want) {
+		t.Errorf("expected shim before page script, got: %s", body)
+	}
+	if !strings.Contains(body, `<a href="/x">`) {
+		t.Errorf("expected links untouched without --base-rewrite, got: %s", body)
+	}
+
+	// Other ports are left alone
+	p = NewProxy(0, false, false)
+	p.ownerCheck = false
+	p.shim, _ = parsePortSet("1")
+	if body := get(p); strings.Contains(body, "__hpcProxyShim") {
+		t.Errorf("shim injected for a port that did not opt in: %s", body)
+	}
+}
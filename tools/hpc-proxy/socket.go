@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"syscall"
+)
+
+// socketRoutePattern matches /socket/:name/*. Names are restricted to a
+// safe character set so they can never escape the socket directory.
+var socketRoutePattern = regexp.MustCompile(`^/socket/([A-Za-z0-9_][A-Za-z0-9._-]*)(/.*)?$`)
+
+// parseSocketRoute extracts the socket name and path from /socket/:name/remaining/path
+func parseSocketRoute(path string) (name string, remaining string, ok bool) {
+	matches := socketRoutePattern.FindStringSubmatch(path)
+	if matches == nil {
+		return "", "", false
+	}
+	remaining = matches[2]
+	if remaining == "" {
+		remaining = "/"
+	}
+	return matches[1], remaining, true
+}
+
+// socketOwner returns the owner UID of the socket file at path, or an
+// error if it does not exist or is not a socket
+func socketOwner(path string) (int, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return 0, fmt.Errorf("%s is not a socket", path)
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("cannot read owner of %s", path)
+	}
+	return int(stat.Uid), nil
+}
+
+// handleSocket proxies HTTP and WebSocket requests to a Unix socket in
+// the socket directory, with the same rewriting as /port/:port
+func (p *Proxy) handleSocket(w http.ResponseWriter, r *http.Request, name, path string) {
+	if p.socketDir == "" {
+		http.Error(w, "Socket routing is disabled", http.StatusNotFound)
+		return
+	}
+
+	socketPath := filepath.Join(p.socketDir, name)
+	owner, err := socketOwner(socketPath)
+	if err != nil {
+		log.Printf("Proxy error to socket %s: %v", name, err)
+		p.serveFailure(w, r, p.diagnose(upstreamTarget{socketPath: socketPath}, err))
+		return
+	}
+	if p.ownerCheck && owner != p.uid {
+		log.Printf("Refusing socket %s: owned by uid %d", name, owner)
+		p.serveFailure(w, r, p.diagnose(upstreamTarget{socketPath: socketPath}, errPortNotOwned))
+		return
+	}
+
+	if p.verbose {
+		log.Printf("%s %s -> unix:%s%s", r.Method, r.URL.Path, socketPath, path)
+	}
+
+	p.forward(w, r, upstreamTarget{
+		host:       "localhost",
+		socketPath: socketPath,
+	}, routeContext{
+		prefix:      p.externalPrefix + "/socket/" + name,
+		path:        path,
+		rewrite:     p.baseRewrite,
+		location:    p.autoRewrite,
+		shim:        p.shim.all,
+		hostRewrite: p.hostRewrite.all,
+		origin:      p.originPolicy(0),
+	})
+}
+
+// listeningSocket describes a Unix socket upstream in the socket directory
+type listeningSocket struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	URL  string `json:"url"`
+}
+
+// listUserSockets returns the sockets in the socket directory owned by the
+// proxy's UID, sorted by name
+func (p *Proxy) listUserSockets() ([]listeningSocket, error) {
+	sockets := []listeningSocket{}
+	if p.socketDir == "" {
+		return sockets, nil
+	}
+	entries, err := os.ReadDir(p.socketDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return sockets, nil
+		}
+		return nil, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !socketRoutePattern.MatchString("/socket/" + name) {
+			continue
+		}
+		path := filepath.Join(p.socketDir, name)
+		owner, err := socketOwner(path)
+		if err != nil || owner != p.uid {
+			continue
+		}
+		sockets = append(sockets, listeningSocket{
+			Name: name,
+			Path: path,
+			URL:  p.externalPrefix + "/socket/" + name + "/",
+		})
+	}
+	sort.Slice(sockets, func(i, j int) bool { return sockets[i].Name < sockets[j].Name })
+	return sockets, nil
+}
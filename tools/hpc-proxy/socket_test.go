@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// serveUnix starts an HTTP server on a Unix socket named name in dir
+func serveUnix(t *testing.T, dir, name string, handler http.Handler) {
+	t.Helper()
+	ln, err := net.Listen("unix", filepath.Join(dir, name))
+	if err != nil {
+		t.Skipf("Unix sockets unavailable: %v", err)
+	}
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+}
+
+func TestParseSocketRoute(t *testing.T) {
+	tests := []struct {
+		path          string
+		wantName      string
+		wantRemaining string
+		wantOk        bool
+	}{
+		{"/socket/rstudio/auth-sign-in", "rstudio", "/auth-sign-in", true},
+		{"/socket/jupyter.sock/", "jupyter.sock", "/", true},
+		{"/socket/code-server", "code-server", "/", true},
+		{"/socket/../etc/passwd", "", "", false},
+		{"/socket/.hidden/", "", "", false},
+		{"/socket/", "", "", false},
+		{"/port/5500/", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			name, remaining, ok := parseSocketRoute(tt.path)
+			if ok != tt.wantOk || name != tt.wantName || remaining != tt.wantRemaining {
+				t.Errorf("parseSocketRoute(%q) = (%q, %q, %v), want (%q, %q, %v)",
+					tt.path, name, remaining, ok, tt.wantName, tt.wantRemaining, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestProxySocketRewrite(t *testing.T) {
+	dir := t.TempDir()
+	serveUnix(t, dir, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><head></head><body><a href="/foo">%s</a></body></html>`, r.URL.Path)
+	}))
+
+	p := NewProxy(0, true, false)
+	p.socketDir = dir
+
+	req := httptest.NewRequest("GET", "/socket/app/docs/", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	body := w.Body.String()
+	for _, want := range []string{`href="/socket/app/foo"`, `<base href="/socket/app/docs/">`, ">/docs/<"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in response, got: %s", want, body)
+		}
+	}
+
+	req = httptest.NewRequest("GET", "/socket/app/old", nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if got := w.Header().Get("Location"); got != "/socket/app/new" {
+		t.Errorf("Location = %q, want /socket/app/new", got)
+	}
+}
+
+func TestProxySocketWebSocketUpgrade(t *testing.T) {
+	dir := t.TempDir()
+	serveUnix(t, dir, "ws", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketUpgrade(r) {
+			http.Error(w, "expected upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+		// Echo one line back to prove the stream is bidirectional
+		line, _ := buf.ReadString('\n')
+		buf.WriteString("echo: " + line)
+		buf.Flush()
+	}))
+
+	p := NewProxy(0, false, false)
+	p.socketDir = dir
+	port, err := p.Start()
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer p.Shutdown()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /socket/ws/live HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read upgrade response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 101, got %d: %s", resp.StatusCode, body)
+	}
+
+	fmt.Fprint(conn, "ping\n")
+	line, err := reader.ReadString('\n')
+	if err != nil || line != "echo: ping\n" {
+		t.Errorf("echo = %q (%v), want %q", line, err, "echo: ping\n")
+	}
+}
+
+func TestProxySocketMissing(t *testing.T) {
+	dir := t.TempDir()
+	// A regular file is not a socket
+	os.WriteFile(filepath.Join(dir, "notasocket"), []byte("x"), 0600)
+
+	p := NewProxy(0, false, false)
+	p.socketDir = dir
+
+	for _, path := range []string{"/socket/missing/", "/socket/notasocket/"} {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("%s: expected status 502, got %d", path, w.Code)
+		}
+	}
+
+	p.socketDir = ""
+	req := httptest.NewRequest("GET", "/socket/missing/", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 with socket routing disabled, got %d", w.Code)
+	}
+}
+
+func TestListUserSockets(t *testing.T) {
+	dir := t.TempDir()
+	serveUnix(t, dir, "b-app", http.NotFoundHandler())
+	serveUnix(t, dir, "a-app", http.NotFoundHandler())
+	os.WriteFile(filepath.Join(dir, "readme.txt"), []byte("x"), 0600)
+
+	p := NewProxy(0, false, false)
+	p.socketDir = dir
+
+	sockets, err := p.listUserSockets()
+	if err != nil {
+		t.Fatalf("listUserSockets() error = %v", err)
+	}
+	if len(sockets) != 2 || sockets[0].Name != "a-app" || sockets[1].URL != "/socket/b-app/" {
+		t.Errorf("unexpected sockets: %+v", sockets)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Defaults for requests to ports that are not listening yet
+const (
+	defaultStartupWait = 2 * time.Minute
+	// startupRetryInterval is how often a held API request re-probes the port
+	startupRetryInterval = 250 * time.Millisecond
+	// startupRefresh is how often the page reloads itself without
+	// JavaScript, and startupRefreshGap how long after the last reload a
+	// new one counts as a fresh wait
+	startupRefresh    = 3 * time.Second
+	startupRefreshGap = 10 * time.Second
+)
+
+//go:embed templates/starting.html
+var startingHTML string
+
+// startingTemplate renders the holding page shown while a port comes up
+var startingTemplate = template.Must(template.New("starting").Parse(startingHTML))
+
+// startingData is the view model for templates/starting.html
+type startingData struct {
+	Port      int
+	StatusURL string
+	MaxWait   int // seconds the page keeps polling
+	Refresh   int // seconds between reloads without JavaScript; 0 once given up
+}
+
+// startingReloads tracks how long browsers without JavaScript have been
+// reloading the starting page of each port, since every reload is a new
+// request and only the server can tell when --startup-wait has run out
+type startingReloads struct {
+	mu    sync.Mutex
+	waits map[int]startingReload
+}
+
+type startingReload struct {
+	since, last time.Time
+}
+
+func newStartingReloads() *startingReloads {
+	return &startingReloads{waits: make(map[int]startingReload)}
+}
+
+// served records a starting page for port and returns how long the
+// current wait has lasted. Waits not reloaded for startupRefreshGap are
+// over, so a reload by hand later starts a new one.
+func (s *startingReloads) served(port int, now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p, wait := range s.waits {
+		if now.Sub(wait.last) > startupRefreshGap {
+			delete(s.waits, p)
+		}
+	}
+	wait, ok := s.waits[port]
+	if !ok {
+		wait.since = now
+	}
+	wait.last = now
+	s.waits[port] = wait
+	return now.Sub(wait.since)
+}
+
+// portStatus is returned by the status endpoint polled by the holding page
+type portStatus struct {
+	Port int  `json:"port"`
+	Up   bool `json:"up"`
+}
+
+// serveStatus reports whether ?port=N accepts connections
+func (p *Proxy) serveStatus(w http.ResponseWriter, r *http.Request) {
+	port, err := strconv.Atoi(r.URL.Query().Get("port"))
+	if err != nil || port < 1 || port > 65535 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid port"})
+		return
+	}
+	_, err = p.upstreams.resolve(port)
+	writeJSON(w, http.StatusOK, portStatus{Port: port, Up: err == nil})
+}
+
+// isNavigation reports whether r is a browser loading a page, as opposed
+// to a script's fetch/XHR or a WebSocket
+func isNavigation(r *http.Request) bool {
+	if r.Method != http.MethodGet || isWebSocketUpgrade(r) {
+		return false
+	}
+	if mode := r.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		return mode == "navigate"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// isNotListening reports whether err means nothing accepted the connection
+func isNotListening(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// resolveUpstream finds the address a port listens on. When nothing is
+// listening yet, browser navigations get a page that waits for the port
+// and other requests are held for up to --startup-grace before failing.
+// Any other failure, such as a firewalled port timing out, is diagnosed
+// straight away. It returns false once a response has been written.
+func (p *Proxy) resolveUpstream(w http.ResponseWriter, r *http.Request, port int) (string, bool) {
+	addr, err := p.upstreams.resolve(port)
+	if err == nil {
+		return addr, true
+	}
+
+	if isNotListening(err) && isNavigation(r) && p.startupWait > 0 {
+		p.serveStarting(w, port)
+		return "", false
+	}
+
+	if isNotListening(err) && p.startupGrace > 0 && !isNavigation(r) {
+		deadline := time.NewTimer(p.startupGrace)
+		defer deadline.Stop()
+		ticker := time.NewTicker(startupRetryInterval)
+		defer ticker.Stop()
+	wait:
+		for {
+			select {
+			case <-r.Context().Done():
+				return "", false
+			case <-deadline.C:
+				break wait
+			case <-ticker.C:
+				if addr, err = p.upstreams.resolve(port); err == nil {
+					return addr, true
+				}
+			}
+		}
+	}
+
+	log.Printf("Proxy error to port %d: %v", port, err)
+	p.serveFailure(w, r, p.diagnose(upstreamTarget{port: port}, err))
+	return "", false
+}
+
+// serveStarting renders the holding page for a port that is not up yet
+func (p *Proxy) serveStarting(w http.ResponseWriter, port int) {
+	data := startingData{
+		Port:      port,
+		StatusURL: fmt.Sprintf("%s%s?port=%d", p.externalPrefix, statusPath, port),
+		MaxWait:   int(p.startupWait / time.Second),
+	}
+	if p.startups.served(port, time.Now()) < p.startupWait {
+		data.Refresh = int(startupRefresh / time.Second)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if err := startingTemplate.Execute(w, data); err != nil {
+		log.Printf("Failed to render starting page: %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unusedPort returns a loopback port nothing is listening on
+func unusedPort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	return port
+}
+
+func TestIsNavigation(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		want    bool
+	}{
+		{"browser page load", "GET", map[string]string{"Accept": "text/html,application/xhtml+xml,*/*;q=0.8"}, true},
+		{"fetch metadata navigate", "GET", map[string]string{"Sec-Fetch-Mode": "navigate", "Accept": "*/*"}, true},
+		{"fetch metadata cors", "GET", map[string]string{"Sec-Fetch-Mode": "cors", "Accept": "text/html"}, false},
+		{"API request", "GET", map[string]string{"Accept": "application/json"}, false},
+		{"no Accept", "GET", nil, false},
+		{"form post", "POST", map[string]string{"Accept": "text/html"}, false},
+		{"websocket", "GET", map[string]string{"Accept": "text/html", "Connection": "Upgrade", "Upgrade": "websocket"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/port/3838/", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			if got := isNavigation(req); got != tt.want {
+				t.Errorf("isNavigation() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyStartingPage(t *testing.T) {
+	port := unusedPort(t)
+	p := NewProxy(0, false, false)
+	p.externalPrefix = "/hpc/node01"
+	p.upstreams.hosts = func() []string { return []string{"127.0.0.1"} }
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/port/%d/", port), nil)
+	req.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Retry-After") == "" || w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("expected Retry-After and no-store, got %v", w.Header())
+	}
+	body := w.Body.String()
+	wantStatus := fmt.Sprintf("/hpc/node01/_hpc-proxy/api/status?port=%d", port)
+	if !strings.Contains(body, wantStatus) {
+		t.Errorf("expected status URL %s in page, got: %s", wantStatus, body)
+	}
+	if !strings.Contains(body, "Waiting for the service on port "+strconv.Itoa(port)) {
+		t.Errorf("expected port in page, got: %s", body)
+	}
+
+	p.startupWait = 0
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected status 502 with --startup-wait=0, got %d", w.Code)
+	}
+}
+
+func TestProxyStartingPageStopsRefreshing(t *testing.T) {
+	port := unusedPort(t)
+	p := NewProxy(0, false, false)
+	p.startupWait = 30 * time.Second
+	p.upstreams.hosts = func() []string { return []string{"127.0.0.1"} }
+
+	get := func() string {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/port/%d/", port), nil)
+		req.Header.Set("Accept", "text/html")
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+	const refresh = `<meta http-equiv="refresh" content="3">`
+
+	if body := get(); !strings.Contains(body, refresh) {
+		t.Errorf("expected browsers without JavaScript to reload, got: %s", body)
+	}
+
+	// A browser that has been reloading for longer than --startup-wait
+	p.startups.waits[port] = startingReload{since: time.Now().Add(-time.Minute), last: time.Now()}
+	body := get()
+	if strings.Contains(body, refresh) {
+		t.Errorf("expected reloading to stop after --startup-wait, got: %s", body)
+	}
+	if !strings.Contains(body, "#gaveup { display: block; }") {
+		t.Errorf("expected the gave-up message without JavaScript, got: %s", body)
+	}
+}
+
+func TestStartingReloads(t *testing.T) {
+	s := newStartingReloads()
+	start := time.Now()
+	if got := s.served(3838, start); got != 0 {
+		t.Errorf("first page: waited %v, want 0", got)
+	}
+	if got := s.served(3838, start.Add(startupRefresh)); got != startupRefresh {
+		t.Errorf("reload: waited %v, want %v", got, startupRefresh)
+	}
+	if got := s.served(8888, start.Add(startupRefresh)); got != 0 {
+		t.Errorf("other port: waited %v, want 0", got)
+	}
+
+	// Reloaded by hand long after the last automatic reload
+	later := start.Add(startupRefresh + startupRefreshGap + time.Second)
+	if got := s.served(3838, later); got != 0 {
+		t.Errorf("new wait: waited %v, want 0", got)
+	}
+}
+
+func TestProxyStartingPageOnlyWhenRefused(t *testing.T) {
+	p := NewProxy(0, false, false)
+	p.ownerCheck = false
+	p.startupGrace = 5 * time.Second
+	// TCP to the broadcast address fails without a refusal, as a
+	// firewalled port does
+	p.upstreams.hosts = func() []string { return []string{"255.255.255.255"} }
+
+	req := httptest.NewRequest("GET", "/port/3838/", nil)
+	req.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadGateway || strings.Contains(w.Body.String(), "Waiting for the service") {
+		t.Errorf("expected the diagnostic page, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// API clients are not held for --startup-grace either
+	req.Header.Set("Accept", "application/json")
+	start := time.Now()
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusBadGateway || time.Since(start) >= p.startupGrace {
+		t.Errorf("expected an immediate 502, got %d after %v", w.Code, time.Since(start))
+	}
+}
+
+func TestServeStatus(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	upPort := backend.Listener.Addr().(*net.TCPAddr).Port
+	downPort := unusedPort(t)
+
+	p := NewProxy(0, false, false)
+	p.upstreams.hosts = func() []string { return []string{"127.0.0.1"} }
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantUp     bool
+	}{
+		{fmt.Sprintf("port=%d", upPort), http.StatusOK, true},
+		{fmt.Sprintf("port=%d", downPort), http.StatusOK, false},
+		{"port=abc", http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", statusPath+"?"+tt.query, nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", tt.query, tt.wantStatus, w.Code)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var status portStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatalf("%s: invalid JSON: %v", tt.query, err)
+		}
+		if status.Up != tt.wantUp {
+			t.Errorf("%s: up = %v, want %v", tt.query, status.Up, tt.wantUp)
+		}
+	}
+}
+
+func TestProxyStartupGraceWaitsForPort(t *testing.T) {
+	port := unusedPort(t)
+	p := NewProxy(0, false, false)
+	p.ownerCheck = false
+	p.startupGrace = 5 * time.Second
+	p.upstreams.hosts = func() []string { return []string{"127.0.0.1"} }
+
+	// Start the backend shortly after the request arrives
+	started := make(chan *httptest.Server, 1)
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			started <- nil
+			return
+		}
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "ready")
+		}))
+		srv.Listener = ln
+		srv.Start()
+		started <- srv
+	}()
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/port/%d/api", port), nil)
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if srv := <-started; srv != nil {
+		defer srv.Close()
+	} else {
+		t.Skip("port was taken before the backend could start")
+	}
+	if w.Code != http.StatusOK || w.Body.String() != "ready" {
+		t.Errorf("expected request to wait for the backend, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,100 @@
+// hpc-proxy client-side URL shim. Single-page apps build URLs in
+// JavaScript ("/api/...", "ws://" + location.host + "/ws") that no
+// server-side rewrite can reach, so the calls that take a URL are wrapped
+// to add the proxy route prefix (e.g. /port/5500) to URLs on this host.
+(function (prefix) {
+  "use strict";
+  if (window.__hpcProxyShim) {
+    return;
+  }
+  window.__hpcProxyShim = prefix;
+
+  // routed mirrors isRoutedPath on the Go side
+  var mount = prefix.replace(/\/[^\/]*\/[^\/]*$/, "");
+  function routed(path) {
+    return path.indexOf(mount + "/port/") === 0 || path.indexOf(mount + "/sport/") === 0 ||
+      path.indexOf(mount + "/absport/") === 0 || path === prefix ||
+      path.indexOf(prefix + "/") === 0;
+  }
+
+  // fix prefixes root-relative URLs and absolute URLs on this host, and
+  // returns anything else unchanged
+  function fix(url) {
+    if (typeof URL !== "undefined" && url instanceof URL) {
+      url = url.href;
+    } else if (typeof url !== "string") {
+      return url;
+    }
+    if (url.charAt(0) === "/" && url.charAt(1) !== "/") {
+      return routed(url) ? url : prefix + url;
+    }
+    var m = /^((?:https?|wss?):)?\/\/([^\/?#]*)(.*)$/i.exec(url);
+    if (!m || m[2] !== location.host) {
+      return url;
+    }
+    var rest = m[3].charAt(0) === "/" ? m[3] : "/" + m[3];
+    if (routed(rest)) {
+      return url;
+    }
+    return (m[1] || "") + "//" + m[2] + prefix + rest;
+  }
+
+  var origFetch = window.fetch;
+  if (origFetch) {
+    window.fetch = function (input, init) {
+      if (typeof Request !== "undefined" && input instanceof Request) {
+        var url = fix(input.url);
+        if (url !== input.url) {
+          input = new Request(url, input);
+        }
+      } else {
+        input = fix(input);
+      }
+      return origFetch.call(this, input, init);
+    };
+  }
+
+  if (window.XMLHttpRequest) {
+    var open = XMLHttpRequest.prototype.open;
+    XMLHttpRequest.prototype.open = function (method, url) {
+      var args = Array.prototype.slice.call(arguments);
+      args[1] = fix(url);
+      return open.apply(this, args);
+    };
+  }
+
+  // Constructors are replaced by wrappers sharing their prototype, so
+  // instanceof checks and the readyState constants keep working
+  ["WebSocket", "EventSource"].forEach(function (name) {
+    var Orig = window[name];
+    if (!Orig) {
+      return;
+    }
+    var Wrapped = function (url, options) {
+      if (arguments.length > 1) {
+        return new Orig(fix(url), options);
+      }
+      return new Orig(fix(url));
+    };
+    Wrapped.prototype = Orig.prototype;
+    ["CONNECTING", "OPEN", "CLOSING", "CLOSED"].forEach(function (k) {
+      if (k in Orig) {
+        Wrapped[k] = Orig[k];
+      }
+    });
+    window[name] = Wrapped;
+  });
+
+  ["pushState", "replaceState"].forEach(function (name) {
+    var orig = history[name];
+    if (!orig) {
+      return;
+    }
+    history[name] = function (state, title, url) {
+      if (arguments.length > 2 && url != null) {
+        return orig.call(this, state, title, fix(url));
+      }
+      return orig.apply(this, arguments);
+    };
+  });
+})
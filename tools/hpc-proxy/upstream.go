@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamDialTimeout bounds each connection attempt while resolving which
+// address a port listens on. Local addresses refuse instantly, so this
+// only matters for filtered interfaces.
+const upstreamDialTimeout = 500 * time.Millisecond
+
+// upstreamError reports that no candidate address accepted a connection
+type upstreamError struct {
+	Port  int
+	Tried []string
+	Err   error
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("nothing listening on port %d (tried %s): %v", e.Port, strings.Join(e.Tried, ", "), e.Err)
+}
+
+func (e *upstreamError) Unwrap() error {
+	return e.Err
+}
+
+// upstreamResolver finds the local address a port is reachable on and
+// remembers it, since dev servers differ in what they bind: most use
+// 127.0.0.1 or 0.0.0.0, Node 17+ (Vite, webpack-dev-server) often only
+// ::1, and some only the node's own hostname.
+type upstreamResolver struct {
+	mu    sync.Mutex
+	addrs map[int]string
+
+	// hosts returns candidate hosts in preference order
+	hosts func() []string
+}
+
+func newUpstreamResolver() *upstreamResolver {
+	return &upstreamResolver{
+		addrs: make(map[int]string),
+		hosts: candidateHosts,
+	}
+}
+
+// resolve returns "host:port" for the first candidate accepting a TCP
+// connection, using the remembered address when there is one
+func (u *upstreamResolver) resolve(port int) (string, error) {
+	u.mu.Lock()
+	addr, ok := u.addrs[port]
+	u.mu.Unlock()
+	if ok {
+		return addr, nil
+	}
+
+	var tried []string
+	var lastErr error
+	for _, host := range u.hosts() {
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		tried = append(tried, addr)
+		conn, err := net.DialTimeout("tcp", addr, upstreamDialTimeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		conn.Close()
+
+		u.mu.Lock()
+		u.addrs[port] = addr
+		u.mu.Unlock()
+		return addr, nil
+	}
+	return "", &upstreamError{Port: port, Tried: tried, Err: lastErr}
+}
+
+// forget drops the remembered address for port, e.g. after a proxy error,
+// so the next request probes all candidates again
+func (u *upstreamResolver) forget(port int) {
+	u.mu.Lock()
+	delete(u.addrs, port)
+	u.mu.Unlock()
+}
+
+// candidateHosts lists loopback addresses first, then the node's hostname
+// addresses and other interface addresses, without duplicates
+func candidateHosts() []string {
+	hosts := []string{"127.0.0.1", "::1"}
+	seen := map[string]bool{"127.0.0.1": true, "::1": true}
+	add := func(ip net.IP) {
+		// Link-local addresses need a zone and are never where dev servers bind
+		if ip == nil || ip.IsLinkLocalUnicast() {
+			return
+		}
+		s := ip.String()
+		if !seen[s] {
+			seen[s] = true
+			hosts = append(hosts, s)
+		}
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		if addrs, err := net.LookupHost(hostname); err == nil {
+			for _, a := range addrs {
+				add(net.ParseIP(a))
+			}
+		}
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok {
+				add(ipNet.IP)
+			}
+		}
+	}
+	return hosts
+}
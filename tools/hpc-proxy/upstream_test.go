@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// listenIPv6Loopback starts an HTTP server bound only to [::1]
+func listenIPv6Loopback(t *testing.T, handler http.Handler) (*httptest.Server, int) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Listener.Close()
+	srv.Listener = ln
+	srv.Start()
+	return srv, ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestUpstreamResolverFallsBackToIPv6(t *testing.T) {
+	srv, port := listenIPv6Loopback(t, http.NotFoundHandler())
+	defer srv.Close()
+
+	u := newUpstreamResolver()
+	u.hosts = func() []string { return []string{"127.0.0.1", "::1"} }
+
+	addr, err := u.resolve(port)
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+	if want := "[::1]:" + strconv.Itoa(port); addr != want {
+		t.Errorf("resolve() = %q, want %q", addr, want)
+	}
+
+	// The working address is remembered, even if candidates change
+	u.hosts = func() []string { return nil }
+	if cached, err := u.resolve(port); err != nil || cached != addr {
+		t.Errorf("expected cached address %q, got %q (%v)", addr, cached, err)
+	}
+
+	u.forget(port)
+	if _, err := u.resolve(port); err == nil {
+		t.Error("expected forget() to drop the cached address")
+	}
+}
+
+func TestUpstreamResolverReportsTried(t *testing.T) {
+	// Grab a free port and release it so nothing is listening
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	u := newUpstreamResolver()
+	u.hosts = func() []string { return []string{"127.0.0.1", "::1"} }
+
+	_, err = u.resolve(port)
+	var upErr *upstreamError
+	if !errors.As(err, &upErr) {
+		t.Fatalf("expected upstreamError, got %v", err)
+	}
+	p := strconv.Itoa(port)
+	if strings.Join(upErr.Tried, ",") != "127.0.0.1:"+p+",[::1]:"+p {
+		t.Errorf("Tried = %v", upErr.Tried)
+	}
+}
+
+func TestCandidateHosts(t *testing.T) {
+	hosts := candidateHosts()
+	if len(hosts) < 2 || hosts[0] != "127.0.0.1" || hosts[1] != "::1" {
+		t.Errorf("expected loopback addresses first, got %v", hosts)
+	}
+	seen := make(map[string]bool)
+	for _, h := range hosts {
+		if seen[h] {
+			t.Errorf("duplicate candidate %s in %v", h, hosts)
+		}
+		seen[h] = true
+	}
+}
+
+func TestProxyServeHTTPIPv6Upstream(t *testing.T) {
+	srv, port := listenIPv6Loopback(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello from ::1"))
+	}))
+	defer srv.Close()
+
+	p := NewProxy(0, false, false)
+
+	req := httptest.NewRequest("GET", "/port/"+strconv.Itoa(port)+"/", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || w.Body.String() != "hello from ::1" {
+		t.Errorf("expected response from IPv6 upstream, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestProxyUnavailableListsAddresses(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	ln.Close()
+
+	p := NewProxy(0, false, false)
+	p.upstreams.hosts = func() []string { return []string{"127.0.0.1", "::1"} }
+
+	req := httptest.NewRequest("GET", "/port/"+port+"/", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected status 502, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "127.0.0.1:"+port) || !strings.Contains(w.Body.String(), "[::1]:"+port) {
+		t.Errorf("expected attempted addresses in error, got: %s", w.Body.String())
+	}
+}